@@ -0,0 +1,99 @@
+package forge_connect
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// BroadcastResult is the outcome of a broadcast task on one client
+type BroadcastResult struct {
+	AppID  string `json:"app_id"`
+	TaskID string `json:"task_id"`
+	Status string `json:"status"` // STATUS_SUCCESS, STATUS_FAILED, STATUS_CANCELLED, STATUS_DEAD, STATUS_TIMEOUT or STATUS_OFFLINE
+	Result string `json:"result"`
+	Error  string `json:"error"`
+}
+
+// RunBroadcastTask send the task to every client of appIDs, or to all registered clients when appIDs is empty,
+// and wait until every client reported or the broadcast timeout is reached.
+// The returned map is keyed by appID and holds one entry per target client, a client whose task was denied
+// by the task policies or could not be queued gets STATUS_FAILED with the error.
+func (s *Server) RunBroadcastTask(appIDs []string, taskType, payload string) (results map[string]*BroadcastResult, err error) {
+	return s.RunBroadcastTaskWithPriority(appIDs, taskType, payload, PRIORITY_NORMAL)
+}
+
+// RunBroadcastTaskWithPriority same as RunBroadcastTask, the tasks are queued with the priority
+func (s *Server) RunBroadcastTaskWithPriority(appIDs []string, taskType, payload string, priority int) (results map[string]*BroadcastResult, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	if err = checkTaskType(taskType); err != nil {
+		return
+	}
+	if len(appIDs) == 0 {
+		appIDs, err = s.store.ListClientIDs()
+		if err != nil {
+			return
+		}
+	}
+
+	results = make(map[string]*BroadcastResult, len(appIDs))
+	pending := make(map[string]string) // appID => taskID
+	for _, appID := range appIDs {
+		if _, ok := results[appID]; ok {
+			continue
+		}
+		result := &BroadcastResult{AppID: appID}
+		results[appID] = result
+		if liveErr := s.AppLiveCheck(appID); liveErr != nil {
+			result.Status = STATUS_OFFLINE
+			result.Error = liveErr.Error()
+			continue
+		}
+		taskID, pushErr := s.pushTask(appID, Task{TaskType: taskType, Payload: payload, Priority: priority})
+		if pushErr != nil {
+			// denied by the task policies or not queued, the other clients still receive the task
+			result.Status = STATUS_FAILED
+			result.Error = pushErr.Error()
+			continue
+		}
+		result.TaskID = taskID
+		pending[appID] = taskID
+	}
+	if s.IsDebug {
+		log.Printf("[DEBUG] add broadcast task: %d clients, %d online", len(results), len(pending))
+	}
+
+	ticker := time.NewTicker(s.taskWaitTick)
+	defer ticker.Stop()
+	timeout := time.After(s.broadcastTimeout)
+	for len(pending) > 0 {
+		select {
+		case <-ticker.C:
+			for appID, taskID := range pending {
+				task, popErr := s.store.PopResult(appID, taskID)
+				if popErr != nil {
+					continue
+				}
+				delete(pending, appID)
+				if openErr := s.openTask(appID, &task); openErr != nil {
+					results[appID].Status = STATUS_FAILED
+					results[appID].Error = openErr.Error()
+					continue
+				}
+				results[appID].Status = task.DoStatus
+				results[appID].Result = task.Result
+				results[appID].Error = task.Error
+			}
+		case <-timeout:
+			for appID, taskID := range pending {
+				results[appID].Status = STATUS_TIMEOUT
+				results[appID].Error = fmt.Sprintf("timeout waiting for task %s", taskID)
+			}
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package forge_connect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunBroadcastTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithBroadcastTimeout(500 * time.Millisecond)
+	c1 := registerTestClient(t, ts, "app-1")
+	registerTestClient(t, ts, "app-2")
+
+	type broadcast struct {
+		results map[string]*BroadcastResult
+		err     error
+	}
+	done := make(chan broadcast, 1)
+	go func() {
+		results, err := s.RunBroadcastTask([]string{"app-1", "app-2", "app-3", "app-1"}, "uptime", "")
+		done <- broadcast{results, err}
+	}()
+	task := fetchTestTask(t, c1)
+	task.Result, task.DoStatus = "up 3 days", STATUS_SUCCESS
+	c1.pushTaskResult(task)
+
+	b := <-done
+	if b.err != nil || len(b.results) != 3 {
+		t.Fatalf("RunBroadcastTask = %v, %v", b.results, b.err)
+	}
+	if r := b.results["app-1"]; r.Status != STATUS_SUCCESS || r.Result != "up 3 days" || r.TaskID != task.TaskID {
+		t.Errorf("app-1 result = %+v", r)
+	}
+	if r := b.results["app-2"]; r.Status != STATUS_TIMEOUT || r.TaskID == "" {
+		t.Errorf("app-2 result = %+v", r)
+	}
+	if r := b.results["app-3"]; r.Status != STATUS_OFFLINE || r.TaskID != "" {
+		t.Errorf("app-3 result = %+v", r)
+	}
+}
+
+func TestRunBroadcastTaskToAllClients(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithBroadcastTimeout(200 * time.Millisecond)
+	registerTestClient(t, ts, "app-1")
+	registerTestClient(t, ts, "app-2")
+
+	results, err := s.RunBroadcastTask(nil, "uptime", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results["app-1"] == nil || results["app-2"] == nil {
+		t.Fatalf("RunBroadcastTask targets = %v", results)
+	}
+}
+
+func TestRunBroadcastTaskContinuesOnPushError(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithBroadcastTimeout(2 * time.Second)
+	c1 := registerTestClient(t, ts, "app-1")
+	registerTestClient(t, ts, "app-2")
+	s.WithStore(failingAppStore{Store: s.store, appID: "app-1"})
+	c2 := NewForge("app-2", "secret-app-2").SetServerAddr(ts.URL)
+
+	type broadcast struct {
+		results map[string]*BroadcastResult
+		err     error
+	}
+	done := make(chan broadcast, 1)
+	go func() {
+		results, err := s.RunBroadcastTask([]string{"app-1", "app-2"}, "uptime", "")
+		done <- broadcast{results, err}
+	}()
+	task := fetchTestTask(t, c2)
+	task.Result, task.DoStatus = "up 1 day", STATUS_SUCCESS
+	c2.pushTaskResult(task)
+
+	b := <-done
+	if b.err != nil || len(b.results) != 2 {
+		t.Fatalf("RunBroadcastTask = %v, %v", b.results, b.err)
+	}
+	if r := b.results["app-1"]; r.Status != STATUS_FAILED || r.TaskID != "" || r.Error == "" {
+		t.Errorf("app-1 result = %+v", r)
+	}
+	if r := b.results["app-2"]; r.Status != STATUS_SUCCESS || r.Result != "up 1 day" {
+		t.Errorf("app-2 result = %+v", r)
+	}
+	if _, errno, err := c1.GetTask(); err == nil || errno != 2 {
+		t.Fatalf("GetTask of app-1 = %v, errno %d", err, errno)
+	}
+}
@@ -1,5 +1,104 @@
 package forge_connect
 
+import "strconv"
+
 func GetClientInfoKey(appId string) string {
 	return "client:" + appId + ":info"
 }
+
+func GetClientPingKey(appId string) string {
+	return "client:" + appId + ":ping"
+}
+
+func GetTaskKey(appId, taskId string) string {
+	return "client:" + appId + ":task:" + taskId
+}
+
+func GetTaskMessageKey(appId, taskId string) string {
+	return "client:" + appId + ":task:" + taskId + ":messages"
+}
+
+func GetTaskQueueKey(appId string) string {
+	return "client:" + appId + ":task_queue"
+}
+
+// GetPriorityQueueKey PRIORITY_NORMAL tasks use the plain task queue
+func GetPriorityQueueKey(appId string, priority int) string {
+	switch priority {
+	case PRIORITY_LOW:
+		return GetTaskQueueKey(appId) + ":low"
+	case PRIORITY_HIGH:
+		return GetTaskQueueKey(appId) + ":high"
+	case PRIORITY_URGENT:
+		return GetTaskQueueKey(appId) + ":urgent"
+	}
+	return GetTaskQueueKey(appId)
+}
+
+func GetProcessingQueueKey(appId string) string {
+	return "client:" + appId + ":processing_queue"
+}
+
+func GetTaskLockKey(appId, taskId string) string {
+	return "lock:client:" + appId + ":task:" + taskId
+}
+
+func GetTaskResultKey(appId, taskId string) string {
+	return "client:" + appId + ":task:" + taskId + ":result"
+}
+
+func GetClientIndexKey() string {
+	return "client:index"
+}
+
+func GetCancelSetKey(appId string) string {
+	return "client:" + appId + ":cancel_set"
+}
+
+func GetDeadQueueKey(appId string) string {
+	return "client:" + appId + ":dead_queue"
+}
+
+func GetScheduleKey(scheduleId string) string {
+	return "schedule:" + scheduleId
+}
+
+func GetScheduleDueKey() string {
+	return "schedule:due"
+}
+
+func GetScheduleRunKey(scheduleId string, runAt int64, appId string) string {
+	return "schedule:" + scheduleId + ":run:" + strconv.FormatInt(runAt, 10) + ":" + appId
+}
+
+func GetPolicyKey(policyId string) string {
+	return "policy:" + policyId
+}
+
+func GetPolicyIndexKey() string {
+	return "policy:index"
+}
+
+func GetNonceKey(appId, nonce string) string {
+	return "nonce:" + appId + ":" + nonce
+}
+
+func GetRateLimitKey(api, scope, id string, slot int64) string {
+	return "ratelimit:" + api + ":" + scope + ":" + id + ":" + strconv.FormatInt(slot, 10)
+}
+
+func GetAuthFailKey(scope, id string) string {
+	return "authfail:" + scope + ":" + id
+}
+
+func GetLockoutKey(scope, id string) string {
+	return "lockout:" + scope + ":" + id
+}
+
+func GetEnrollTokenKey(tokenId string) string {
+	return "enroll:" + tokenId
+}
+
+func GetEnrollUsesKey(tokenId string) string {
+	return "enroll:" + tokenId + ":uses"
+}
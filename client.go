@@ -3,35 +3,83 @@ package forge_connect
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
+	"runtime/debug"
 	"sync"
 	"time"
 )
 
 type TaskFunc func(task *Task) (result string)
 
+// TaskHandler handles a task, ctx is cancelled when the server cancels the task.
+// A returned error marks the task as STATUS_FAILED and is passed to the server caller.
+type TaskHandler func(ctx context.Context, task *Task) (result string, err error)
+
 type Client struct {
 	AppID         string
 	IsDebug       bool
-	registered    bool
+	state         string // One of the STATE_ constants
 	secret        string
-	baseSecret    string
+	enrollToken   string
+	secretFile    string
+	certFile      string
+	keyFile       string
+	clientCert    *tls.Certificate
 	serverAddr    string
 	mu            sync.Mutex
 	checkInterval int
 	taskInterval  time.Duration
+	taskPublicKey ed25519.PublicKey
+	taskMaxAge    time.Duration
+	allowedTypes  []string
 	skipSSL       bool
 	HttpClient    *http.Client
-	callbackFunc  TaskFunc
+	handler       TaskHandler
+	labels        map[string]string
+	running       map[string]*runningTask
+
+	previousSecret string // Secret replaced by the last rotation, for tasks sealed before it
+
+	ctx          context.Context // Cancelled by Close or a fatal error, stops polling and health check
+	stop         context.CancelFunc
+	loops        sync.WaitGroup // Polling and health check goroutines
+	inflight     sync.WaitGroup // Running task handlers
+	drainTimeout time.Duration
+	unsent       []*Task // Results the server did not acknowledge, sent again later
+	onError      func(err error)
+	failOnce     sync.Once
+	reconnectMu  sync.Mutex // Serializes the registrations of reconnect
+	failed       chan struct{}
+	fatalErr     error
+
+	started       bool      // Polling and health check are running
+	registeredAt  time.Time // Time of the last successful registration
+	onStateChange func(from, to string)
+
+	workers     chan struct{}            // Concurrency slots of the client, nil when unlimited
+	typeWorkers map[string]chan struct{} // Concurrency slots per task type
+	maxQueued   int                      // Tasks waiting for their task type slot before polling pauses, 0 when unlimited
+	stats       ClientStats
+
+	routes      map[string]TaskHandler // Handlers by task type, see Handle
+	middlewares []Middleware
+
+	journal *taskJournal // Results of the done tasks, see OpenJournal
+
+	delivered map[string]int // Tasks fetched and not done, the pings extend their delivery locks
+}
+
+// runningTask is a task handled by the client
+type runningTask struct {
+	cancel    context.CancelFunc
+	encrypted bool
 }
 
 // NewForge initializes the client configuration
@@ -39,13 +87,28 @@ func NewForge(appID, secret string) *Client {
 	if appID == "" || secret == "" {
 		panic("appid/secret not found.")
 	}
+	ctx, stop := context.WithCancel(context.Background())
 	return &Client{
 		AppID:         appID,
 		secret:        secret,
-		baseSecret:    DEFAULT_SECRET,
 		checkInterval: 10,
 		taskInterval:  1 * time.Second,
+		taskMaxAge:    24 * time.Hour,
 		HttpClient:    &http.Client{Timeout: 60 * time.Second},
+		running:       make(map[string]*runningTask),
+		state:         STATE_DISCONNECTED,
+		ctx:           ctx,
+		stop:          stop,
+		drainTimeout:  30 * time.Second,
+		failed:        make(chan struct{}),
+		typeWorkers:   make(map[string]chan struct{}),
+		maxQueued:     defaultMaxQueued,
+		routes:        make(map[string]TaskHandler),
+		delivered:     make(map[string]int),
+		stats: ClientStats{
+			RunningByType: make(map[string]int),
+			QueuedByType:  make(map[string]int),
+		},
 	}
 }
 
@@ -70,9 +133,10 @@ func (c *Client) GetServerAddr() (addr string) {
 	return c.serverAddr
 }
 
-// GetConnecteState returns the connection state of the client
+// GetConnecteState returns whether the client is registered, possibly degraded
 func (c *Client) GetConnecteState() (connected bool) {
-	return c.registered
+	state := c.State()
+	return state == STATE_REGISTERED || state == STATE_DEGRADED
 }
 
 // SetServerAddr updates the client configuration of server addr
@@ -93,6 +157,43 @@ func (c *Client) SetSkipSSL(i bool) *Client {
 	return c
 }
 
+// SetLabels set the labels declared on Regist, servers target clients with label selectors
+func (c *Client) SetLabels(labels map[string]string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.labels = labels
+	return c
+}
+
+// SetEnrollToken set the enrollment token minted by the server operator,
+// it is required for the first registration of the appID
+func (c *Client) SetEnrollToken(token string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enrollToken = token
+	return c
+}
+
+// SetTaskPublicKey pin the public key of the server task signing key, see Server.WithTaskSigningKey.
+// Tasks without valid signature are reported as failed and never reach the handler.
+func (c *Client) SetTaskPublicKey(key ed25519.PublicKey) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.taskPublicKey = key
+	return c
+}
+
+// SetTaskMaxAge set how long after their creation the signed tasks are accepted, 24 hours by default, 0 disables it.
+// It bounds the replay of a captured task, OpenJournal also keeps a task done within the retention from running again.
+func (c *Client) SetTaskMaxAge(maxAge time.Duration) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if maxAge >= 0 {
+		c.taskMaxAge = maxAge
+	}
+	return c
+}
+
 func (c *Client) SetTaskDelay(timeout time.Duration) *Client {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -102,22 +203,14 @@ func (c *Client) SetTaskDelay(timeout time.Duration) *Client {
 	return c
 }
 
-// generateSignature creates an HMAC-SHA256 signature based on appName, secret, and the provided payload.
-func (c *Client) generateSignature(api, dateTime, payload string) string {
-	secret := c.secret
-	if api == "register" {
-		secret = c.baseSecret
-	}
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(c.AppID + payload + dateTime))
-	return hex.EncodeToString(h.Sum(nil))
+// generateSignature creates a v2 HMAC-SHA256 signature of the canonical request to the api.
+func (c *Client) generateSignature(api, dateTime, nonce, payload string) string {
+	return c.generateSignatureBySecret(c.getSecret(), api, dateTime, nonce, payload)
 }
 
-// generateSignatureBySecret creates an HMAC-SHA256 signature based on appName, secret, and the provided payload.
-func (c *Client) generateSignatureBySecret(secret, dateTime, payload string) string {
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(c.AppID + payload + dateTime))
-	return hex.EncodeToString(h.Sum(nil))
+// generateSignatureBySecret creates a v2 HMAC-SHA256 signature of the canonical request with the secret.
+func (c *Client) generateSignatureBySecret(secret, api, dateTime, nonce, payload string) string {
+	return hmacSign(secret, canonicalRequest("POST", c.getApi(api), c.AppID, dateTime, nonce, payload))
 }
 
 // ensureServerAddr checks if serverAddr is set
@@ -135,73 +228,281 @@ func (c *Client) ensureConfig() {
 
 // Regist regist app info for server
 func (c *Client) Regist(callback TaskFunc) (respData string, errno int, err error) {
+	var handler TaskHandler
+	if callback != nil {
+		handler = func(ctx context.Context, task *Task) (string, error) {
+			return callback(task), nil
+		}
+	}
+	return c.RegistHandler(handler)
+}
+
+// RegistHandler regist app info for server and handle the tasks with a context-aware handler
+func (c *Client) RegistHandler(handler TaskHandler) (respData string, errno int, err error) {
 	c.ensureConfig()
+	respData, errno, err = c.register()
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	if handler != nil {
+		c.handler = handler
+	}
+	started := c.started
+	c.started = true
+	c.mu.Unlock()
+	if started {
+		return
+	}
+	c.loops.Add(2)
+	go func() {
+		defer c.loops.Done()
+		c.helthCheck(c.checkInterval)
+	}()
+	go func() {
+		defer c.loops.Done()
+		c.listenGetTask()
+	}()
+	return
+}
+
+// register sends the registration request, the client is registered on success
+func (c *Client) register() (respData string, errno int, err error) {
+	c.setState(STATE_CONNECTING)
+	defer func() {
+		if err != nil {
+			c.setState(STATE_DISCONNECTED)
+		}
+	}()
 	params := RegistrationRequest{
 		AppID:  c.AppID,
-		Secret: c.secret,
+		Secret: c.getSecret(),
+		Labels: c.labels,
 	}
+	certKey, csrPEM, err := c.prepareCertEnrollment()
+	if err != nil {
+		return "", 1, err
+	}
+	params.CSR = csrPEM
 	paramsJson, _ := json.Marshal(params)
 
-	resp, errno, err := c.SendHTTPRequest("register", string(paramsJson))
+	resp, errno, err := c.sendRequest(c.ctx, "register", string(paramsJson))
 
 	if err != nil {
 		return
 	}
-	respData, _ = resp.(string)
-	if callback != nil {
-		c.callbackFunc = callback
+	if certKey != nil {
+		// switch to the certificate issued for the CSR
+		certPEM := ""
+		if data, ok := resp.(map[string]interface{}); ok {
+			certPEM, _ = data["certificate"].(string)
+		}
+		if err = c.saveEnrolledCert(certKey, certPEM); err != nil {
+			return "", 1, err
+		}
 	}
-	c.registered = true
+	respData, _ = resp.(string)
+	c.mu.Lock()
+	c.registeredAt = time.Now()
+	c.mu.Unlock()
+	c.setState(STATE_REGISTERED)
 	consoleLog("INFO", "AgentInit success <===> forgeServer %s", c.serverAddr)
-	go c.helthCheck(c.checkInterval)
-	go c.listenGetTask()
 	return
 }
 
-// Start starts the client to listen for tasks and perform health checks
+// listenGetTask polls the server for tasks until the client is closed,
+// the client registers again when the server no longer accepts its credentials
 func (c *Client) listenGetTask() {
 	isRegistStatus := c.GetConnecteState()
 	if isRegistStatus == false {
 		return
 	}
-	if c.callbackFunc == nil {
-		consoleLog("ERROR", "callbackFunc is not set, please set it before starting the client.")
+	c.mu.Lock()
+	noHandler := c.handler == nil && len(c.routes) == 0
+	c.mu.Unlock()
+	if noHandler {
+		consoleLog("ERROR", "task handler is not set, please set it before starting the client.")
 		return
 	}
 
-	for {
+	errCnt := 0
+	for c.ctx.Err() == nil {
+		// polling pauses while the queue is full or every worker is busy
+		if !c.waitQueueRoom() {
+			break
+		}
+		release, ok := c.acquireWorker()
+		if !ok {
+			break
+		}
+		since := time.Now()
 		task, errno, err := c.GetTask()
+		if err != nil {
+			release()
+		}
+		if c.ctx.Err() != nil {
+			// the poll was aborted by Close
+			release()
+			break
+		}
 		if err != nil && errno == 2 {
 			if c.IsDebug {
 				consoleLog("DEBUG", "GetTask context canceled or no task.")
 			}
 		}
+		if err != nil && errno == 3 {
+			consoleLog("ERROR", "GetTask %v", err)
+			c.sleep(time.Duration(c.checkInterval) * time.Second)
+			continue
+		}
+		if err != nil && errno == 4 {
+			// the server lost the client or rejects its credentials
+			c.reconnect(since, err)
+			errCnt = 0
+			continue
+		}
 		if err != nil && errno != 2 {
-			consoleLog("ERROR", "GetTask context error: %v, errno: %d", err, errno)
+			errCnt++
+			interval := fibonacciBackoff(errCnt, maxReconnectInterval)
+			consoleLog("ERROR", "GetTask context error: %v, errno: %d, retry in %ds", err, errno, interval)
+			c.setState(STATE_DEGRADED)
+			c.sleep(time.Duration(interval) * time.Second)
+			continue
+		}
+		if errCnt > 0 {
+			errCnt = 0
+			c.setState(STATE_REGISTERED)
+		}
+		if task != nil && !c.startTask(task, release) {
+			release()
 			break
 		}
-		if task != nil {
-			go func() {
-				result := c.callbackFunc(task)
-				task.Result = result
-				task.DoStatus = STATUS_SUCCESS
-				c.pushTaskResult(task)
-			}()
+		c.sleep(c.taskInterval)
+	}
+	consoleLog("INFO", "GetTask polling stopped.")
+}
+
+// runTask call the handler with a cancelable task context and report the result, see execTask
+func (c *Client) runTask(task *Task) {
+	c.mu.Lock()
+	done, ok := c.trackTask(task)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	defer done()
+	c.execTask(task)
+}
+
+// trackTask gives the task a cancelable context and registers it, so that the server can cancel it
+// from the moment it is fetched, done unregisters it. It returns false when the task is already queued
+// or running, e.g. delivered again after its lock expired. The caller must hold c.mu.
+func (c *Client) trackTask(task *Task) (done func(), ok bool) {
+	if _, ok = c.running[task.TaskID]; ok {
+		consoleLog("INFO", "task is already running, taskID: %s", task.TaskID)
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	task.ctx = ctx
+	c.running[task.TaskID] = &runningTask{cancel: cancel, encrypted: task.Encrypted}
+	return func() {
+		cancel()
+		c.mu.Lock()
+		delete(c.running, task.TaskID)
+		c.mu.Unlock()
+	}, true
+}
+
+// execTask call the handler with the context of the tracked task and report the result,
+// a panic of the handler is reported as a failed task with its stack
+func (c *Client) execTask(task *Task) {
+	ctx := task.ctx
+	handler := c.callHandler
+	if isInternalTask(task.TaskType) {
+		handler = c.internalHandler(task.TaskType)
+	}
+	var result string
+	err := c.verifyTask(task)
+	if err == nil {
+		if entry, ok := c.journalLookup(task.TaskID); ok {
+			c.replayResult(task, entry)
+			return
 		}
-		time.Sleep(c.taskInterval)
+		err = c.allowTask(task)
+	}
+	if err == nil && task.Encrypted {
+		err = openFields(c.secretCandidates(), c.AppID, task.TaskID, &task.Payload)
+	}
+	if err == nil && ctx.Err() != nil {
+		// cancelled while it waited for its task type slot
+		err = ctx.Err()
+	}
+	if err == nil {
+		result, err = handler(ctx, task)
+	}
+	task.Result = result
+	task.DoStatus = STATUS_SUCCESS
+	if err != nil {
+		task.DoStatus = STATUS_FAILED
+		task.Error = err.Error()
+	}
+	if ctx.Err() != nil {
+		task.DoStatus = STATUS_CANCELLED
 	}
-	consoleLog("ERROR", "------------disconnect server------------")
-	os.Exit(1)
+	if task.Encrypted {
+		c.sealResult(task)
+	}
+	if task.DoStatus != STATUS_CANCELLED {
+		// cancelled by the server it is not delivered again, cancelled by Close it must run again
+		c.journalRecord(task)
+	}
+	c.pushTaskResult(task)
 }
 
-// Ping sends a ping request to the server
+// callHandler call the routed handler and recover its panic
+func (c *Client) callHandler(ctx context.Context, task *Task) (result string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			consoleLog("ERROR", "task handler panic, taskID: %s, %v", task.TaskID, r)
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return c.route(task.TaskType)(ctx, task)
+}
+
+// internalHandler returns the handler of a forge protocol task, they never reach the user handler
+func (c *Client) internalHandler(taskType string) TaskHandler {
+	switch taskType {
+	case TASK_ROTATE_SECRET:
+		return c.rotateSecret
+	}
+	return func(ctx context.Context, task *Task) (string, error) {
+		return "", fmt.Errorf("unsupported internal task type %s", task.TaskType)
+	}
+}
+
+// cancelTask cancel the context of a running task
+func (c *Client) cancelTask(taskID string) {
+	c.mu.Lock()
+	running, ok := c.running[taskID]
+	c.mu.Unlock()
+	if ok {
+		consoleLog("INFO", "task cancelled by server, taskID: %s", taskID)
+		running.cancel()
+	}
+}
+
+// pushTaskResult reports the result of a task, a result the server did not receive is kept for flushResults
 func (c *Client) pushTaskResult(task *Task) {
 	c.ensureConfig()
 	params, _ := json.Marshal(task)
-	resp, _, err := c.SendHTTPRequest("reportTask", string(params))
+	resp, errno, err := c.SendHTTPRequest("reportTask", string(params))
 
 	if err != nil {
-		consoleLog("ERROR", "pushTaskResult response: %v", resp)
+		consoleLog("ERROR", "pushTaskResult error: %v, taskID: %s", err, task.TaskID)
+		if notDelivered(err, errno) {
+			c.queueResult(task)
+		}
 		return
 	}
 	respData, _ := resp.(string)
@@ -210,16 +511,42 @@ func (c *Client) pushTaskResult(task *Task) {
 	return
 }
 
+// PushTaskMessage sends an intermediate message of a continuous task to the server,
+// msgType is one of LOG_TYPE, ERR_TYPE or SUCC_TYPE. The stream is closed once the
+// task callback returns and its result is reported.
+func (c *Client) PushTaskMessage(taskID, msgType, content string) (err error) {
+	c.ensureConfig()
+	msg := TaskMessage{
+		TaskID:   taskID,
+		MsgType:  msgType,
+		Content:  content,
+		CreateAt: time.Now(),
+	}
+	c.mu.Lock()
+	running, ok := c.running[taskID]
+	c.mu.Unlock()
+	if ok && running.encrypted {
+		if err = sealFields(c.getSecret(), c.AppID, taskID, &msg.Content); err != nil {
+			return
+		}
+		msg.Encrypted = true
+	}
+	params, _ := json.Marshal(msg)
+	_, _, err = c.SendHTTPRequest("reportMessage", string(params))
+	if err != nil && c.IsDebug {
+		consoleLog("DEBUG", "PushTaskMessage error: %v", err)
+	}
+	return
+}
+
 // helthCheck 连接健康检查
 func (c *Client) helthCheck(second int) {
 	isRegistStatus := c.GetConnecteState()
 	if isRegistStatus == false {
 		return
 	}
-	// Close health check before exiting the process
-	// 创建 Context
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Close stops the health check
+	ctx := c.ctx
 	interval := second
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	defer ticker.Stop()
@@ -235,17 +562,30 @@ func (c *Client) helthCheck(second int) {
 				consoleLog("DEBUG", "ConnectHealthCheck interval %v.", second)
 			}
 
-			err := c.Ping()
-			if err != nil {
+			since := time.Now()
+			errno, err := c.ping()
+			if err != nil && errno == 4 {
+				// the server lost the client or rejects its credentials
+				c.reconnect(since, err)
+				errCnt = 0
+				interval = second
+			} else if err != nil {
 				errCnt++
 				interval = fibonacciBackoff(errCnt, 7200)
+				c.setState(STATE_DEGRADED)
 				if errCnt > 3 {
 					consoleLog("ERROR", "ConnectHealthCheck err %v, errCnt:%v, interval:%v", err.Error(), errCnt, interval)
-					c.registered = false
+					c.reconnect(since, err)
+					errCnt = 0
+					interval = second
 				}
 			} else {
+				if errCnt > 0 {
+					c.setState(STATE_REGISTERED)
+				}
 				errCnt = 0
 				interval = second
+				c.flushResults(ctx)
 			}
 
 			ticker.Stop()
@@ -256,25 +596,43 @@ func (c *Client) helthCheck(second int) {
 
 // Ping sends a ping request to the server
 func (c *Client) Ping() (err error) {
+	_, err = c.ping()
+	return
+}
+
+// ping sends a ping request and cancels the tasks cancelled by the server
+func (c *Client) ping() (errno int, err error) {
 	c.ensureConfig()
-	resp, _, err := c.SendHTTPRequest("ping", "ping")
+	pingReq := PingRequest{}
+	c.mu.Lock()
+	for taskID := range c.delivered {
+		pingReq.Tasks = append(pingReq.Tasks, taskID)
+	}
+	c.mu.Unlock()
+	params, _ := json.Marshal(pingReq)
+	resp, errno, err := c.SendHTTPRequest("ping", string(params))
 
 	if err != nil {
-		return err
+		return errno, err
 	}
-	respData, _ := resp.(string)
+	respJson, _ := json.Marshal(resp)
+	respData := PingResponse{}
+	json.Unmarshal(respJson, &respData)
 
 	if c.IsDebug {
-		consoleLog("DEBUG", "ping response: %s", respData)
+		consoleLog("DEBUG", "ping response: %s", respData.Message)
+	}
+	for _, taskID := range respData.CancelTasks {
+		c.cancelTask(taskID)
 	}
 
-	return
+	return 0, nil
 }
 
 // GetTask polls the server for a new task
 func (c *Client) GetTask() (task *Task, errno int, err error) {
 	c.ensureConfig()
-	resp, errno, err := c.SendHTTPRequest("getTask", "")
+	resp, errno, err := c.sendRequest(c.ctx, "getTask", "")
 	if err != nil {
 		return nil, errno, err
 	}
@@ -288,24 +646,41 @@ func (c *Client) GetTask() (task *Task, errno int, err error) {
 
 // SendHTTPRequest 发送HTTP请求并返回响应结果
 func (c *Client) SendHTTPRequest(api, payload string) (interface{}, int, error) {
+	return c.sendRequest(context.Background(), api, payload)
+}
+
+// sendRequest sends a signed request, the request is aborted when ctx is done
+func (c *Client) sendRequest(ctx context.Context, api, payload string) (interface{}, int, error) {
 	var apiResp interface{}
 	// 创建HTTP客户端并设置超时时间
 	client := c.HttpClient
 	apiUrl := c.serverAddr + c.getApi(api)
 
-	req, err := http.NewRequest("POST", apiUrl, bytes.NewReader([]byte(payload)))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiUrl, bytes.NewReader([]byte(payload)))
 	if err != nil {
 		return apiResp, 1, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	dateTime := TimeFormat(time.Now())
-	signature := c.generateSignature(api, dateTime, payload)
+	nonce := randomHex(16)
+	signature := c.generateSignature(api, dateTime, nonce, payload)
 
 	reqHeader := map[string]string{
-		"X-FORGE-SIGN":  signature,
-		"X-FORGE-APPID": c.AppID,
-		"X-FORGE-TIME":  dateTime,
-		"Content-Type":  "application/json",
+		"X-FORGE-SIGN":         signature,
+		"X-FORGE-SIGN-VERSION": SIGN_V2,
+		"X-FORGE-APPID":        c.AppID,
+		"X-FORGE-TIME":         dateTime,
+		"X-FORGE-NONCE":        nonce,
+		"Content-Type":         "application/json",
+	}
+	if api == "register" && c.enrollToken != "" {
+		// the token secret signs the request but is never sent
+		tokenID, tokenSecret, err := parseEnrollToken(c.enrollToken)
+		if err != nil {
+			return apiResp, 1, err
+		}
+		reqHeader["X-FORGE-ENROLL"] = tokenID
+		reqHeader["X-FORGE-ENROLL-SIGN"] = c.generateSignatureBySecret(tokenSecret, api, dateTime, nonce, payload)
 	}
 	for key, value := range reqHeader {
 		req.Header.Set(key, value)
@@ -313,13 +688,17 @@ func (c *Client) SendHTTPRequest(api, payload string) (interface{}, int, error)
 	// 发送请求
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", 1, fmt.Errorf("request failed: %v", err)
+		return "", 1, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	// 检查响应状态码
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// rate limited or locked out, the caller retries later
+		return apiResp, 3, fmt.Errorf("request rejected with status code %d, retry after %ss", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
 	if resp.StatusCode != http.StatusOK {
-		return apiResp, 1, fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, payload)
+		return apiResp, 1, &statusError{code: resp.StatusCode, payload: payload}
 	}
 	respData := Response{}
 	err = json.Unmarshal(body, &respData)
@@ -333,6 +712,16 @@ func (c *Client) SendHTTPRequest(api, payload string) (interface{}, int, error)
 	return respData.Data, 1, nil
 }
 
+// statusError is a response with an unexpected HTTP status, e.g. from a proxy in front of the server
+type statusError struct {
+	code    int
+	payload string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("request failed with status code %d: %s", e.code, e.payload)
+}
+
 func (c *Client) getApi(key string) (apiUrl string) {
 
 	apiUrl, _ = apiRoutes[key]
@@ -0,0 +1,58 @@
+package forge_connect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", date(2024, 1, 1, 10, 7), date(2024, 1, 1, 10, 15)},
+		{"0 2 * * *", date(2024, 1, 1, 3, 0), date(2024, 1, 2, 2, 0)},
+		{"@hourly", date(2024, 1, 1, 10, 0), date(2024, 1, 1, 11, 0)},
+		{"@yearly", date(2024, 6, 1, 0, 0), date(2025, 1, 1, 0, 0)},
+		{"30 9 * * 1-5", date(2024, 1, 6, 12, 0), date(2024, 1, 8, 9, 30)},
+		{"0 0 * * 7", date(2024, 1, 1, 0, 0), date(2024, 1, 7, 0, 0)},
+		{"5,10 0 * * *", date(2024, 1, 1, 0, 5), date(2024, 1, 1, 0, 10)},
+		{"0 0 13 * 5", date(2024, 1, 1, 0, 0), date(2024, 1, 5, 0, 0)},
+		{"0 0 29 2 *", date(2024, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		{"0 0 30 2 *", date(2024, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		cron, err := ParseCron(tt.spec)
+		if err != nil {
+			t.Errorf("ParseCron(%q) error: %v", tt.spec, err)
+			continue
+		}
+		if got := cron.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("ParseCron(%q).Next(%v) = %v, want %v", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every",
+	} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) accepted an invalid expression", spec)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package forge_connect
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // Response defines the unified API response structure
 type Response struct {
@@ -17,11 +21,89 @@ type Task struct {
 	CreateAt time.Time `json:"create_at"`
 	Payload  string    `json:"payload"` // Task-specific data (e.g., JSON)
 	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"` // Client-side error of a failed task
+
+	Priority  int       `json:"priority"`   // PRIORITY_LOW to PRIORITY_URGENT, higher priorities are delivered first
+	Attempts  int       `json:"attempts"`   // Number of deliveries to the client
+	DeliverAt time.Time `json:"deliver_at"` // Time of the last delivery
+
+	Continuous bool `json:"continuous,omitempty"` // Task streams messages through reportMessage
+	Encrypted  bool `json:"encrypted,omitempty"`  // Payload, result and error are sealed with the client key
+
+	Signature string `json:"signature,omitempty"` // Ed25519 signature of the server, see Server.WithTaskSigningKey
+
+	ctx context.Context
+}
+
+// Context returns the context of the task on the client, it is cancelled when the server cancels the task
+func (t *Task) Context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// TaskError is returned to the server caller when a task does not finish successfully
+type TaskError struct {
+	TaskID  string
+	Status  string // STATUS_FAILED, STATUS_CANCELLED or STATUS_DEAD
+	Message string // Error reported by the client
+}
+
+func (e *TaskError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("task %s %s", e.TaskID, e.Status)
+	}
+	return fmt.Sprintf("task %s %s: %s", e.TaskID, e.Status, e.Message)
+}
+
+// PingRequest is the body of the ping api, older clients send "ping"
+type PingRequest struct {
+	Tasks []string `json:"tasks"` // TaskIDs fetched and not reported yet, their delivery locks are extended
+}
+
+// PingResponse is returned by the ping api
+type PingResponse struct {
+	Message     string   `json:"message"`
+	CancelTasks []string `json:"cancel_tasks"` // TaskIDs the client must cancel
+}
+
+// TaskMessage defines an intermediate message pushed by a client while a continuous task runs
+type TaskMessage struct {
+	TaskID   string    `json:"task_id"`
+	MsgType  string    `json:"msg_type"` // LOG_TYPE, ERR_TYPE, SUCC_TYPE or EXPIRE_TYPE
+	Content  string    `json:"content"`
+	Done     bool      `json:"done"` // Last message of the stream
+	CreateAt time.Time `json:"create_at"`
+
+	Encrypted bool `json:"encrypted,omitempty"` // Content is sealed with the client key
 }
 
 type RegistrationRequest struct {
-	AppID  string `json:"app_id"`
-	Secret string `json:"secret"`
+	AppID  string            `json:"app_id"`
+	Secret string            `json:"secret"`
+	Labels map[string]string `json:"labels,omitempty"`
+	CSR    string            `json:"csr,omitempty"` // PEM certificate request signed by the server CA
+}
+
+// RegistrationResponse is returned by the register api
+type RegistrationResponse struct {
+	ClientInfo
+	Certificate string `json:"certificate,omitempty"` // PEM client certificate issued for the CSR
+}
+
+// taskPriorities in delivery order
+var taskPriorities = []int{PRIORITY_URGENT, PRIORITY_HIGH, PRIORITY_NORMAL, PRIORITY_LOW}
+
+// normalizePriority clamp the priority into PRIORITY_LOW..PRIORITY_URGENT
+func normalizePriority(priority int) int {
+	if priority < PRIORITY_LOW {
+		return PRIORITY_LOW
+	}
+	if priority > PRIORITY_URGENT {
+		return PRIORITY_URGENT
+	}
+	return priority
 }
 
 // API routes shared by client and server
@@ -30,6 +112,8 @@ var apiRoutes = map[string]string{
 	"ping":       "/orange-forge/api/ping",
 	"getTask":    "/orange-forge/api/getTask",
 	"reportTask": "/orange-forge/api/reportTask",
+
+	"reportMessage": "/orange-forge/api/reportMessage",
 }
 
 const (
@@ -37,13 +121,37 @@ const (
 	STATUS_DOING   = "doing"
 	STATUS_TIMEOUT = "timeout"
 	STATUS_SUCCESS = "success"
+	STATUS_OFFLINE = "offline"
+
+	STATUS_CANCELLED = "cancelled"
+	STATUS_FAILED    = "failed"
+	STATUS_DEAD      = "dead"
 
 	LOG_TYPE    = "logging"
 	ERR_TYPE    = "error"
 	EXPIRE_TYPE = "timeout"
 	SUCC_TYPE   = "success"
 
-	RDX_EXPIRE = 604800
+	PRIORITY_LOW    = -1
+	PRIORITY_NORMAL = 0
+	PRIORITY_HIGH   = 1
+	PRIORITY_URGENT = 2
+
+	RDX_EXPIRE    = 604800
+	RESULT_EXPIRE = 3600
+	LIVE_EXPIRE   = 90
 
 	DEFAULT_SECRET = "orange-forge"
+
+	AUTH_HMAC = "hmac" // Requests are signed with the client secret
+	AUTH_MTLS = "mtls" // Requests are authenticated by the client certificate
+	AUTH_ANY  = "any"  // Either of both, for migrating to mTLS
+
+	INTERNAL_TASK_PREFIX = "forge:"              // Task types reserved for the forge protocol
+	TASK_ROTATE_SECRET   = "forge:rotate_secret" // Delivers a new secret to the client, see Server.RotateSecret
+
+	STATE_CONNECTING   = "connecting"   // The client is registering
+	STATE_REGISTERED   = "registered"   // The client polls tasks
+	STATE_DEGRADED     = "degraded"     // Requests to the server fail, the client retries with backoff
+	STATE_DISCONNECTED = "disconnected" // The client is not registered, or closed
 )
@@ -0,0 +1,179 @@
+package forge_connect
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+// payloadKey derives the AES-256 key of a client from its secret
+func payloadKey(secret, appID string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("orange-forge-payload:" + appID))
+	return h.Sum(nil)
+}
+
+// newAEAD returns the AES-GCM cipher of the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealString encrypts the text bound to the additional data, encoded as base64(nonce | sealed data)
+func sealString(aead cipher.AEAD, plain, additional string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(additional))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openString decrypts a text of sealString
+func openString(aead cipher.AEAD, sealed, additional string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted data")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(additional))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// sealFields encrypts the non-empty fields in place with the client key, the ciphertext is bound to the appID and taskID
+func sealFields(secret, appID, taskID string, fields ...*string) error {
+	aead, err := newAEAD(payloadKey(secret, appID))
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if *field == "" {
+			continue
+		}
+		if *field, err = sealString(aead, *field, appID+":"+taskID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openFields decrypts the non-empty fields in place with the first of the secrets that authenticates them
+func openFields(secrets []string, appID, taskID string, fields ...*string) error {
+	for _, field := range fields {
+		if *field == "" {
+			continue
+		}
+		opened := false
+		for _, secret := range secrets {
+			aead, err := newAEAD(payloadKey(secret, appID))
+			if err != nil {
+				return err
+			}
+			if plain, err := openString(aead, *field, appID+":"+taskID); err == nil {
+				*field = plain
+				opened = true
+				break
+			}
+		}
+		if !opened {
+			return errors.New("failed to decrypt payload")
+		}
+	}
+	return nil
+}
+
+// WithPayloadEncryption encrypt the payloads of new tasks with a key derived from the client secret,
+// the clients encrypt the results and messages of these tasks, so the store only keeps ciphertext.
+// Payloads of scheduled tasks are encrypted when they are due.
+func (s *Server) WithPayloadEncryption(enable bool) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.encryptPayload = enable
+	return s
+}
+
+// sealTask encrypts the payload of the task with the current secret of the client
+func (s *Server) sealTask(appID string, task *Task) error {
+	clientInfo, err := s.store.GetClientInfo(appID)
+	if err != nil {
+		return err
+	}
+	secret, _, err := s.openSecrets(clientInfo)
+	if err != nil {
+		return err
+	}
+	if err = sealFields(secret, appID, task.TaskID, &task.Payload); err != nil {
+		return err
+	}
+	task.Encrypted = true
+	return nil
+}
+
+// openTask decrypts the payload, result and error of an encrypted task
+func (s *Server) openTask(appID string, task *Task) error {
+	if !task.Encrypted {
+		return nil
+	}
+	clientInfo, err := s.store.GetClientInfo(appID)
+	if err != nil {
+		return err
+	}
+	secrets, err := s.secretCandidates(clientInfo)
+	if err != nil {
+		return err
+	}
+	if err = openFields(secrets, appID, task.TaskID, &task.Payload, &task.Result, &task.Error); err != nil {
+		return err
+	}
+	task.Encrypted = false
+	return nil
+}
+
+// openMessage decrypts the content of an encrypted task message
+func (s *Server) openMessage(appID string, msg *TaskMessage) error {
+	if !msg.Encrypted {
+		return nil
+	}
+	clientInfo, err := s.store.GetClientInfo(appID)
+	if err != nil {
+		return err
+	}
+	secrets, err := s.secretCandidates(clientInfo)
+	if err != nil {
+		return err
+	}
+	if err = openFields(secrets, appID, msg.TaskID, &msg.Content); err != nil {
+		return err
+	}
+	msg.Encrypted = false
+	return nil
+}
+
+// secretCandidates returns the secrets the client decrypts payloads with
+func (c *Client) secretCandidates() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.previousSecret == "" {
+		return []string{c.secret}
+	}
+	return []string{c.secret, c.previousSecret}
+}
+
+// sealResult encrypts the result and error of an encrypted task, the decrypted payload is not sent back
+func (c *Client) sealResult(task *Task) {
+	task.Payload = ""
+	if err := sealFields(c.getSecret(), c.AppID, task.TaskID, &task.Result, &task.Error); err != nil {
+		consoleLog("ERROR", "encrypt task result error: %v, taskID: %s", err, task.TaskID)
+		task.DoStatus, task.Result, task.Error = STATUS_FAILED, "", ""
+	}
+}
@@ -0,0 +1,108 @@
+package forge_connect
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSealOpenFields(t *testing.T) {
+	payload, result := "payload", ""
+	if err := sealFields("secret", "app-1", "t1", &payload, &result); err != nil {
+		t.Fatal(err)
+	}
+	if payload == "payload" || result != "" {
+		t.Fatalf("sealed fields = %q, %q", payload, result)
+	}
+	sealed := payload
+
+	for _, tt := range []struct {
+		name    string
+		secrets []string
+		appID   string
+		taskID  string
+	}{
+		{"wrong secret", []string{"other"}, "app-1", "t1"},
+		{"other app", []string{"secret"}, "app-2", "t1"},
+		{"other task", []string{"secret"}, "app-1", "t2"},
+	} {
+		field := sealed
+		if err := openFields(tt.secrets, tt.appID, tt.taskID, &field); err == nil {
+			t.Errorf("%s: openFields succeeded", tt.name)
+		}
+	}
+	// a payload sealed before a rotation opens with the previous secret
+	if err := openFields([]string{"rotated", "secret"}, "app-1", "t1", &payload, &result); err != nil || payload != "payload" {
+		t.Fatalf("openFields = %q, %v", payload, err)
+	}
+}
+
+func TestEncryptedTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithPayloadEncryption(true)
+	c := registerTestClient(t, ts, "app-1")
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		return "echo:" + task.Payload, nil
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, body, err := s.RunSingleTask("app-1", "echo", "hello")
+		done <- result{body, err}
+	}()
+	task := fetchTestTask(t, c)
+	if !task.Encrypted || task.Payload == "hello" {
+		t.Fatalf("fetched task = %+v", task)
+	}
+	taskID := task.TaskID
+	c.runTask(task)
+
+	if r := <-done; r.err != nil || r.body != "echo:hello" {
+		t.Fatalf("RunSingleTask = %q, %v", r.body, r.err)
+	}
+	// the store only keeps ciphertext
+	stored, err := s.store.GetTask("app-1", taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Payload == "hello" || stored.Result == "" || stored.Result == "echo:hello" {
+		t.Fatalf("stored task = %+v", stored)
+	}
+}
+
+func TestEncryptedContinuousTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithPayloadEncryption(true)
+	c := registerTestClient(t, ts, "app-1")
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		return "eof", c.PushTaskMessage(task.TaskID, LOG_TYPE, "line of "+task.Payload)
+	}
+
+	_, messages, err := s.ContinuousTask("app-1", "tail", "app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTask(fetchTestTask(t, c))
+
+	var got []TaskMessage
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, msg)
+		case <-timeout:
+			t.Fatal("stream not closed")
+		}
+	}
+	if len(got) != 2 || got[0].Content != "line of app.log" || got[1].Content != "eof" || got[1].Encrypted {
+		t.Fatalf("messages = %+v", got)
+	}
+}
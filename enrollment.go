@@ -0,0 +1,144 @@
+package forge_connect
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// EnrollmentToken authorizes the first registration of clients, it is minted by an operator with CreateEnrollmentToken
+type EnrollmentToken struct {
+	TokenID      string            `json:"token_id"`
+	Secret       string            `json:"secret"`         // Signs the registration request, never sent by the client
+	AppIDPattern string            `json:"app_id_pattern"` // Glob of the allowed appIDs, e.g. "web-*", empty allows any
+	Labels       map[string]string `json:"labels"`         // Labels forced onto the enrolled clients
+	MaxUses      int               `json:"max_uses"`
+	ExpireAt     time.Time         `json:"expire_at"`
+	CreateAt     time.Time         `json:"create_at"`
+}
+
+// EnrollmentOptions scope a new enrollment token
+type EnrollmentOptions struct {
+	AppIDPattern string            // Glob of the allowed appIDs, empty allows any
+	Labels       map[string]string // Labels forced onto the enrolled clients
+	MaxUses      int               // Number of registrations, 0 means single-use
+	TTL          time.Duration     // Validity, 0 means 24 hours
+}
+
+// Token returns the value handed to the client with Client.SetEnrollToken
+func (t EnrollmentToken) Token() string {
+	return t.TokenID + "." + t.Secret
+}
+
+// CreateEnrollmentToken mints a token allowing MaxUses registrations of appIDs matching the pattern
+func (s *Server) CreateEnrollmentToken(opts EnrollmentOptions) (token EnrollmentToken, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	if opts.AppIDPattern != "" {
+		if _, err = path.Match(opts.AppIDPattern, ""); err != nil {
+			return token, fmt.Errorf("invalid app_id pattern: %v", err)
+		}
+	}
+	if err = validateLabels(opts.Labels); err != nil {
+		return
+	}
+	if opts.MaxUses <= 0 {
+		opts.MaxUses = 1
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+
+	now := time.Now()
+	token = EnrollmentToken{
+		TokenID:      randomHex(8),
+		Secret:       randomHex(32),
+		AppIDPattern: opts.AppIDPattern,
+		Labels:       opts.Labels,
+		MaxUses:      opts.MaxUses,
+		ExpireAt:     now.Add(opts.TTL),
+		CreateAt:     now,
+	}
+	err = s.store.SaveEnrollToken(token, opts.TTL)
+	return
+}
+
+// RevokeEnrollmentToken deletes an enrollment token before it is used up or expired
+func (s *Server) RevokeEnrollmentToken(tokenID string) (err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	return s.store.DeleteEnrollToken(tokenID)
+}
+
+// ResetClient forgets a registered client, the appID can then be registered again with an enrollment token
+func (s *Server) ResetClient(appID string) (err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	return s.store.DeleteClientInfo(appID)
+}
+
+// WithLegacyRegistration accept new registrations without enrollment token, signed with the client secret
+// or the DEFAULT_SECRET of older clients. Only meant for migrating existing deployments.
+func (s *Server) WithLegacyRegistration(enable bool) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.legacyRegistration = enable
+	return s
+}
+
+// verifyEnrollment checks the enrollment headers of a registration and consumes one use of the token
+func (s *Server) verifyEnrollment(r *http.Request, args requestArgs) (token EnrollmentToken, err error) {
+	appID := args.AppID
+	tokenID := r.Header.Get("X-FORGE-ENROLL")
+	enrollSign := r.Header.Get("X-FORGE-ENROLL-SIGN")
+	if tokenID == "" || enrollSign == "" {
+		return token, authError("enrollment token required")
+	}
+	token, err = s.store.GetEnrollToken(tokenID)
+	if errors.Is(err, ErrNotFound) {
+		return token, authError("enrollment token not found")
+	}
+	if err != nil {
+		return
+	}
+	if time.Now().After(token.ExpireAt) {
+		return token, authError("enrollment token expired")
+	}
+	if token.AppIDPattern != "" {
+		if matched, _ := path.Match(token.AppIDPattern, appID); !matched {
+			return token, authError("app_id is not allowed by the enrollment token")
+		}
+	}
+	expectedSign := s.computeSignature(args, token.Secret)
+	if !hmac.Equal([]byte(expectedSign), []byte(enrollSign)) {
+		return token, authError("enrollment signature verification failed")
+	}
+
+	uses, err := s.store.UseEnrollToken(tokenID, time.Until(token.ExpireAt))
+	if err != nil {
+		return
+	}
+	if uses > int64(token.MaxUses) {
+		return token, authError("enrollment token is used up")
+	}
+	return token, nil
+}
+
+// parseEnrollToken split the "<token_id>.<secret>" value of an enrollment token
+func parseEnrollToken(value string) (tokenID, secret string, err error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("invalid enrollment token")
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,88 @@
+package forge_connect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnrollment(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLegacyRegistration(false)
+
+	if err := sendRegistration(newTestClient(ts, "web-1")); err == nil {
+		t.Fatal("registration without enrollment token accepted")
+	}
+	token, err := s.CreateEnrollmentToken(EnrollmentOptions{
+		AppIDPattern: "web-*",
+		Labels:       map[string]string{"region": "eu"},
+		MaxUses:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sendRegistration(newTestClient(ts, "db-1").SetEnrollToken(token.Token())); err == nil {
+		t.Fatal("registration of an appID outside the token pattern accepted")
+	}
+	web1 := newTestClient(ts, "web-1").SetEnrollToken(token.Token()).SetLabels(map[string]string{"region": "us"})
+	if err = sendRegistration(web1); err != nil {
+		t.Fatal(err)
+	}
+	if err = sendRegistration(newTestClient(ts, "web-2").SetEnrollToken(token.Token())); err != nil {
+		t.Fatal(err)
+	}
+	if err = sendRegistration(newTestClient(ts, "web-3").SetEnrollToken(token.Token())); err == nil {
+		t.Fatal("registration with a used up token accepted")
+	}
+
+	// the token labels override the labels declared by the client
+	if clients, _ := s.ListClients("region=eu"); len(clients) != 2 {
+		t.Fatalf("clients with the token labels = %+v", clients)
+	}
+	// re-registration requires the current secret, not a token
+	if err = sendRegistration(newTestClient(ts, "web-1")); err != nil {
+		t.Fatal("re-registration with the current secret:", err)
+	}
+	if err = sendRegistration(NewForge("web-1", "stolen").SetServerAddr(ts.URL)); err == nil {
+		t.Fatal("re-registration with another secret accepted")
+	}
+	if err = s.ResetClient("web-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sendRegistration(NewForge("web-1", "stolen").SetServerAddr(ts.URL)); err == nil {
+		t.Fatal("registration after ResetClient without token accepted")
+	}
+}
+
+func TestEnrollmentTokenRevokedOrExpired(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLegacyRegistration(false)
+
+	revoked, err := s.CreateEnrollmentToken(EnrollmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RevokeEnrollmentToken(revoked.TokenID); err != nil {
+		t.Fatal(err)
+	}
+	if err = sendRegistration(newTestClient(ts, "app-1").SetEnrollToken(revoked.Token())); err == nil {
+		t.Fatal("registration with a revoked token accepted")
+	}
+
+	expired, err := s.CreateEnrollmentToken(EnrollmentOptions{TTL: 1500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1600 * time.Millisecond)
+	if err = sendRegistration(newTestClient(ts, "app-1").SetEnrollToken(expired.Token())); err == nil {
+		t.Fatal("registration with an expired token accepted")
+	}
+
+	forged := revoked
+	forged.Secret = "forged"
+	if err = sendRegistration(newTestClient(ts, "app-1").SetEnrollToken(forged.Token())); err == nil {
+		t.Fatal("registration with a forged token secret accepted")
+	}
+	if _, err = s.CreateEnrollmentToken(EnrollmentOptions{AppIDPattern: "web-["}); err == nil {
+		t.Fatal("CreateEnrollmentToken accepted an invalid pattern")
+	}
+}
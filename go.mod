@@ -3,6 +3,6 @@ module github.com/zhuCheer/orange-forge-connect
 go 1.17
 
 require (
-	github.com/gomodule/redigo v1.9.2 // indirect
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/gomodule/redigo v1.9.2
+	github.com/google/uuid v1.6.0
 )
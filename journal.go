@@ -0,0 +1,235 @@
+package forge_connect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// journalCompactEvery is the number of appended entries after which the journal file is rewritten
+const journalCompactEvery = 1000
+
+// journalEntry is the reported result of a task, encrypted results are kept sealed
+type journalEntry struct {
+	TaskID    string    `json:"task_id"`
+	DoStatus  string    `json:"do_status"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error"`
+	Encrypted bool      `json:"encrypted"`
+	DoneAt    time.Time `json:"done_at"`
+}
+
+// taskJournal is an append-only file of task results, one JSON entry per line
+type taskJournal struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	retention time.Duration
+	entries   map[string]journalEntry
+	appended  int // Entries appended since the last compaction
+}
+
+// OpenJournal records the results of the tasks in the file at path and keeps them for retention, 24 hours by default.
+// A task delivered again within the retention, e.g. after its lock expired or its result was lost,
+// is not run again, its recorded result is reported instead. Call it before Regist.
+func (c *Client) OpenJournal(path string, retention time.Duration) error {
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+	journal, err := openJournal(path, retention)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.journal != nil {
+		c.journal.close()
+	}
+	c.journal = journal
+	return nil
+}
+
+// journalLookup returns the recorded result of the task
+func (c *Client) journalLookup(taskID string) (entry journalEntry, ok bool) {
+	c.mu.Lock()
+	journal := c.journal
+	c.mu.Unlock()
+	if journal == nil {
+		return entry, false
+	}
+	return journal.lookup(taskID)
+}
+
+// journalRecord records the result of the task before it is reported
+func (c *Client) journalRecord(task *Task) {
+	c.mu.Lock()
+	journal := c.journal
+	c.mu.Unlock()
+	if journal == nil {
+		return
+	}
+	err := journal.record(journalEntry{
+		TaskID:    task.TaskID,
+		DoStatus:  task.DoStatus,
+		Result:    task.Result,
+		Error:     task.Error,
+		Encrypted: task.Encrypted,
+		DoneAt:    time.Now(),
+	})
+	if err != nil {
+		consoleLog("ERROR", "journal record error: %v, taskID: %s", err, task.TaskID)
+	}
+}
+
+// closeJournal closes the journal file
+func (c *Client) closeJournal() {
+	c.mu.Lock()
+	journal := c.journal
+	c.journal = nil
+	c.mu.Unlock()
+	if journal == nil {
+		return
+	}
+	if err := journal.close(); err != nil {
+		consoleLog("ERROR", "journal close error: %v", err)
+	}
+}
+
+// replayResult reports the recorded result of a task delivered again instead of running it
+func (c *Client) replayResult(task *Task, entry journalEntry) {
+	consoleLog("INFO", "task already done, reporting the recorded result, taskID: %s", task.TaskID)
+	task.DoStatus, task.Result, task.Error = entry.DoStatus, entry.Result, entry.Error
+	if entry.Encrypted {
+		task.Payload = ""
+	}
+	c.pushTaskResult(task)
+}
+
+// openJournal loads the unexpired entries of the file and opens it for appending
+func openJournal(path string, retention time.Duration) (*taskJournal, error) {
+	j := &taskJournal{
+		path:      path,
+		retention: retention,
+		entries:   make(map[string]journalEntry),
+	}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = j.load(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// load reads the entries, a line torn by a crash is skipped
+func (j *taskJournal) load(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	expireBefore := time.Now().Add(-j.retention)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			entry := journalEntry{}
+			if json.Unmarshal(line, &entry) == nil && entry.TaskID != "" && entry.DoneAt.After(expireBefore) {
+				j.entries[entry.TaskID] = entry
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compact drops the expired entries, rewrites the file and opens it for appending
+func (j *taskJournal) compact() error {
+	var data []byte
+	expireBefore := time.Now().Add(-j.retention)
+	for taskID, entry := range j.entries {
+		if !entry.DoneAt.After(expireBefore) {
+			delete(j.entries, taskID)
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	if err := writeFileAtomic(j.path, data, 0600); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.file = file
+	j.appended = 0
+	return nil
+}
+
+// lookup returns the unexpired entry of the task
+func (j *taskJournal) lookup(taskID string) (entry journalEntry, ok bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, ok = j.entries[taskID]
+	if ok && time.Since(entry.DoneAt) > j.retention {
+		return entry, false
+	}
+	return
+}
+
+// record appends the entry and syncs the file, so the result survives a crash before it is reported
+func (j *taskJournal) record(entry journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries[entry.TaskID] = entry
+	j.appended++
+	if j.appended >= journalCompactEvery {
+		return j.compact()
+	}
+	return nil
+}
+
+// close closes the journal file
+func (j *taskJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,116 @@
+package forge_connect
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalSkipsRedeliveredTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "forge.journal")
+	c := registerTestClient(t, ts, "app-1")
+	if err := c.OpenJournal(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		runs++
+		return "charged", nil
+	}
+
+	taskID, err := s.addTask("app-1", "charge", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := fetchTestTask(t, c)
+	redelivered := *task
+	c.runTask(task)
+	// e.g. the lock expired before the result was reported
+	c.runTask(&redelivered)
+	if runs != 1 {
+		t.Fatalf("task ran %d times", runs)
+	}
+	if stored, err := s.store.GetTask("app-1", taskID); err != nil || stored.DoStatus != STATUS_SUCCESS || stored.Result != "charged" {
+		t.Fatalf("stored task = %+v, %v", stored, err)
+	}
+
+	// the journal survives a restart of the client
+	c.closeJournal()
+	restarted := NewForge("app-1", "secret-app-1")
+	if err = restarted.OpenJournal(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.closeJournal()
+	if entry, ok := restarted.journalLookup(taskID); !ok || entry.Result != "charged" {
+		t.Fatalf("journal entry after restart = %+v, %v", entry, ok)
+	}
+}
+
+func TestJournalLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forge.journal")
+	journal, err := openJournal(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []journalEntry{
+		{TaskID: "t1", DoStatus: STATUS_SUCCESS, DoneAt: time.Now()},
+		{TaskID: "t2", DoStatus: STATUS_FAILED, DoneAt: time.Now().Add(-2 * time.Hour)},
+	} {
+		if err = journal.record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.close()
+	// a crash tore the last line
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"task_id":"t3","do_st`)
+	file.Close()
+
+	journal, err = openJournal(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.close()
+	if _, ok := journal.lookup("t1"); !ok {
+		t.Error("entry t1 not loaded")
+	}
+	for _, taskID := range []string{"t2", "t3"} {
+		if _, ok := journal.lookup(taskID); ok {
+			t.Errorf("expired or torn entry %s loaded", taskID)
+		}
+	}
+}
+
+func TestJournalSkipsCancelledTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	if err := c.OpenJournal(filepath.Join(t.TempDir(), "forge.journal"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer c.closeJournal()
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	if _, err := s.addTask("app-1", "backup", ""); err != nil {
+		t.Fatal(err)
+	}
+	task := fetchTestTask(t, c)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.cancelTask(task.TaskID)
+	}()
+	c.runTask(task)
+	if task.DoStatus != STATUS_CANCELLED {
+		t.Fatalf("task status = %s", task.DoStatus)
+	}
+	if _, ok := c.journalLookup(task.TaskID); ok {
+		t.Fatal("cancelled task recorded in the journal")
+	}
+}
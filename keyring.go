@@ -0,0 +1,135 @@
+package forge_connect
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ClientRecord is the stored form of a registered client. With a master key the secrets are sealed
+// and KeyID names the master key, a record without KeyID keeps its secrets in plaintext.
+type ClientRecord struct {
+	ClientInfo
+	Secret         string `json:"secret"`
+	PreviousSecret string `json:"previous_secret,omitempty"` // Secret replaced by RotateSecret
+	KeyID          string `json:"key_id,omitempty"`
+	CertSerial     string `json:"cert_serial,omitempty"` // Serial of the client certificate accepted for the client
+}
+
+// WithMasterKey add a 32 bytes master key to the keyring and seal the client secrets with it,
+// the keys added before only open the secrets sealed with them until ResealClientSecrets ran.
+func (s *Server) WithMasterKey(keyID string, key []byte) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if keyID == "" || len(key) != 32 {
+		panic("master key requires a key id and 32 bytes")
+	}
+	if s.masterKeys == nil {
+		s.masterKeys = make(map[string][]byte)
+	}
+	s.masterKeys[keyID] = append([]byte(nil), key...)
+	s.masterKeyID = keyID
+	return s
+}
+
+// openSecrets returns the secret and the previous secret of the client record
+func (s *Server) openSecrets(rec ClientRecord) (secret, previous string, err error) {
+	if rec.KeyID == "" {
+		return rec.Secret, rec.PreviousSecret, nil
+	}
+	key, ok := s.masterKeys[rec.KeyID]
+	if !ok {
+		return "", "", fmt.Errorf("master key %s of client %s not found", rec.KeyID, rec.AppID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return
+	}
+	if secret, err = openString(aead, rec.Secret, "orange-forge-secret:"+rec.AppID); err != nil {
+		return "", "", errors.New("failed to open client secret")
+	}
+	if rec.PreviousSecret != "" {
+		if previous, err = openString(aead, rec.PreviousSecret, "orange-forge-secret:"+rec.AppID); err != nil {
+			return "", "", errors.New("failed to open client secret")
+		}
+	}
+	return
+}
+
+// sealSecrets stores the secrets into the record, sealed with the active master key
+func (s *Server) sealSecrets(rec *ClientRecord, secret, previous string) (err error) {
+	rec.Secret, rec.PreviousSecret, rec.KeyID = secret, previous, s.masterKeyID
+	if s.masterKeyID == "" {
+		return nil
+	}
+	aead, err := newAEAD(s.masterKeys[s.masterKeyID])
+	if err != nil {
+		return
+	}
+	if rec.Secret, err = sealString(aead, secret, "orange-forge-secret:"+rec.AppID); err != nil {
+		return
+	}
+	if previous != "" {
+		rec.PreviousSecret, err = sealString(aead, previous, "orange-forge-secret:"+rec.AppID)
+	}
+	return
+}
+
+// secretCandidates returns the secrets a signature or a payload of the client is verified with,
+// the previous secret is accepted during the grace window of a rotation
+func (s *Server) secretCandidates(rec ClientRecord) ([]string, error) {
+	secret, previous, err := s.openSecrets(rec)
+	if err != nil {
+		return nil, err
+	}
+	secrets := []string{secret}
+	if previous != "" && time.Now().Unix() < rec.PreviousSecretExpire {
+		secrets = append(secrets, previous)
+	}
+	return secrets, nil
+}
+
+// saveClient stores the client record, secrets in plaintext or sealed with an older master key
+// are sealed with the active master key first
+func (s *Server) saveClient(rec ClientRecord, expire time.Duration) error {
+	if rec.KeyID != s.masterKeyID {
+		secret, previous, err := s.openSecrets(rec)
+		if err != nil {
+			return err
+		}
+		if err = s.sealSecrets(&rec, secret, previous); err != nil {
+			return err
+		}
+	}
+	return s.store.SaveClientInfo(rec, expire)
+}
+
+// ResealClientSecrets seal the secrets of every registered client with the active master key,
+// run it after WithMasterKey added a new key, the old key can be dropped afterwards.
+func (s *Server) ResealClientSecrets() (resealed int, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	appIDs, err := s.store.ListClientIDs()
+	if err != nil {
+		return
+	}
+	for _, appID := range appIDs {
+		rec, getErr := s.store.GetClientInfo(appID)
+		if errors.Is(getErr, ErrNotFound) {
+			continue
+		}
+		if getErr != nil {
+			return resealed, getErr
+		}
+		if rec.KeyID == s.masterKeyID {
+			continue
+		}
+		if err = s.saveClient(rec, RDX_EXPIRE*time.Second); err != nil {
+			return
+		}
+		resealed++
+	}
+	return
+}
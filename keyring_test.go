@@ -0,0 +1,62 @@
+package forge_connect
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMasterKeySealsClientSecrets(t *testing.T) {
+	s, ts := newTestServer(t)
+	// a client registered before the master key keeps a plaintext secret
+	plain := registerTestClient(t, ts, "app-1")
+	s.WithMasterKey("k1", bytes.Repeat([]byte{1}, 32))
+	sealed := registerTestClient(t, ts, "app-2")
+
+	rec, err := s.store.GetClientInfo("app-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.KeyID != "k1" || rec.Secret == sealed.getSecret() {
+		t.Fatalf("stored record = %+v", rec)
+	}
+
+	s.WithMasterKey("k2", bytes.Repeat([]byte{2}, 32))
+	if resealed, err := s.ResealClientSecrets(); err != nil || resealed != 2 {
+		t.Fatalf("ResealClientSecrets = %d, %v, want 2", resealed, err)
+	}
+	if resealed, _ := s.ResealClientSecrets(); resealed != 0 {
+		t.Fatalf("second ResealClientSecrets = %d, want 0", resealed)
+	}
+	for _, c := range []*Client{plain, sealed} {
+		if err = c.Ping(); err != nil {
+			t.Fatalf("ping of %s: %v", c.AppID, err)
+		}
+	}
+
+	// a secret sealed with a previous key still opens, and is resealed when the client is seen
+	s.WithMasterKey("k3", bytes.Repeat([]byte{3}, 32))
+	if err = sealed.Ping(); err != nil {
+		t.Fatal("secret sealed with the previous key rejected:", err)
+	}
+	if rec, _ = s.store.GetClientInfo("app-2"); rec.KeyID != "k3" {
+		t.Fatalf("record of app-2 sealed with %q, want k3", rec.KeyID)
+	}
+
+	// a server without the key cannot open the secrets
+	other := NewServer("other").WithStore(s.store).WithMasterKey("k1", bytes.Repeat([]byte{1}, 32))
+	if _, _, err = other.openSecrets(rec); err == nil {
+		t.Fatal("secret opened without its master key")
+	}
+	if secret, _, err := s.openSecrets(rec); err != nil || secret != sealed.getSecret() {
+		t.Fatalf("openSecrets = %q, %v", secret, err)
+	}
+}
+
+func TestWithMasterKeyRequires32Bytes(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("WithMasterKey accepted a short key")
+		}
+	}()
+	NewServer("test").WithMasterKey("k1", []byte("short"))
+}
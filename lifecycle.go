@@ -0,0 +1,208 @@
+package forge_connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxUnsentResults bounds the results kept while the server is unreachable, the oldest are dropped
+const maxUnsentResults = 1000
+
+// SetDrainTimeout set how long Run waits for the running tasks on shutdown, 30 seconds by default
+func (c *Client) SetDrainTimeout(timeout time.Duration) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timeout > 0 {
+		c.drainTimeout = timeout
+	}
+	return c
+}
+
+// SetErrorHandler set the callback of the fatal error stopping the client, e.g. the server rejecting a new registration.
+// The client never exits the process, the application decides to re-register, alert or shut down.
+func (c *Client) SetErrorHandler(handler func(err error)) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onError = handler
+	return c
+}
+
+// Err returns the fatal error that stopped the client, nil while it is running or after Close
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fatalErr
+}
+
+// Run blocks until ctx is done or a fatal error stops the client, then closes the client
+// waiting up to the drain timeout for the running tasks. It returns the fatal error, if any.
+func (c *Client) Run(ctx context.Context) (err error) {
+	select {
+	case <-ctx.Done():
+	case <-c.failed:
+		err = c.Err()
+	}
+	c.mu.Lock()
+	timeout := c.drainTimeout
+	c.mu.Unlock()
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if closeErr := c.Close(drainCtx); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// Close stops polling tasks and the health check, waits for the running tasks until ctx is done
+// and sends the results the server did not receive yet. Tasks still running at the deadline are cancelled.
+func (c *Client) Close(ctx context.Context) (err error) {
+	c.mu.Lock()
+	c.stop()
+	c.mu.Unlock()
+	c.setState(STATE_DISCONNECTED)
+
+	if err = waitGroup(ctx, &c.loops); err == nil {
+		err = waitGroup(ctx, &c.inflight)
+	}
+	if err != nil {
+		consoleLog("ERROR", "client close: drain deadline reached, cancelling the running tasks")
+		c.mu.Lock()
+		for _, running := range c.running {
+			running.cancel()
+		}
+		c.mu.Unlock()
+		// the journal stays open for the cancelled handlers still finishing
+		return err
+	}
+	remaining := c.flushResults(ctx)
+	c.closeJournal()
+	if remaining > 0 {
+		return fmt.Errorf("%d task results not sent", remaining)
+	}
+	consoleLog("INFO", "client closed.")
+	return nil
+}
+
+// fail stops the client on a fatal error and reports it to the error handler and Run
+func (c *Client) fail(err error) {
+	c.failOnce.Do(func() {
+		c.mu.Lock()
+		c.fatalErr = err
+		c.stop()
+		handler := c.onError
+		c.mu.Unlock()
+		c.setState(STATE_DISCONNECTED)
+		close(c.failed)
+		if handler != nil {
+			handler(err)
+		}
+	})
+}
+
+// sleep waits for the duration or until the client is closed
+func (c *Client) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-c.ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// startTask runs the task in its own goroutine holding the worker slot, see runQueued, unless the client is closed.
+// The task is tracked before it is queued, so that a cancel of the server reaches it while it waits for its slot.
+func (c *Client) startTask(task *Task, release func()) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		return false
+	}
+	done, ok := c.trackTask(task)
+	if !ok {
+		release()
+		return true
+	}
+	c.inflight.Add(1)
+	c.delivered[task.TaskID]++
+	c.stats.Queued++
+	c.stats.QueuedByType[task.TaskType]++
+	go func() {
+		defer c.inflight.Done()
+		defer done()
+		defer func() {
+			c.mu.Lock()
+			decrement(c.delivered, task.TaskID)
+			c.mu.Unlock()
+		}()
+		c.runQueued(task, release)
+	}()
+	return true
+}
+
+// queueResult keeps a result the server did not receive, for flushResults
+func (c *Client) queueResult(task *Task) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.unsent) >= maxUnsentResults {
+		consoleLog("ERROR", "too many unsent task results, dropping taskID: %s", c.unsent[0].TaskID)
+		c.unsent = c.unsent[1:]
+	}
+	c.unsent = append(c.unsent, task)
+}
+
+// flushResults sends the results kept by queueResult until the server is unreachable again or ctx is done,
+// it returns the number of results still kept
+func (c *Client) flushResults(ctx context.Context) (remaining int) {
+	c.mu.Lock()
+	unsent := c.unsent
+	c.unsent = nil
+	c.mu.Unlock()
+
+	for i, task := range unsent {
+		params, _ := json.Marshal(task)
+		_, errno, err := c.sendRequest(ctx, "reportTask", string(params))
+		if err != nil && notDelivered(err, errno) {
+			c.mu.Lock()
+			c.unsent = append(unsent[i:], c.unsent...)
+			remaining = len(c.unsent)
+			c.mu.Unlock()
+			return
+		}
+		if err != nil {
+			consoleLog("ERROR", "flush task result error: %v, taskID: %s", err, task.TaskID)
+			continue
+		}
+		consoleLog("INFO", "flushed task result, taskID: %s", task.TaskID)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.unsent)
+}
+
+// notDelivered reports whether a request failed before the server handled it, so it can be sent again.
+// A 5xx status comes from a proxy or a failing server and is sent again as well.
+func notDelivered(err error, errno int) bool {
+	var urlErr *url.Error
+	var statusErr *statusError
+	return errno == 3 || errors.As(err, &urlErr) || errors.As(err, &statusErr) && statusErr.code >= 500
+}
+
+// waitGroup waits for the group until ctx is done
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
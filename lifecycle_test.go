@@ -0,0 +1,153 @@
+package forge_connect
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startTestClient registers the client with the handler and starts its polling, the client is closed with the test
+func startTestClient(t *testing.T, c *Client, handler TaskHandler) *Client {
+	c.SetTaskDelay(20 * time.Millisecond)
+	if _, _, err := c.RegistHandler(handler); err != nil {
+		t.Fatal("RegistHandler:", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Close(ctx)
+	})
+	return c
+}
+
+func TestServerClientRoundTrip(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithSingleTimeout(10 * time.Second)
+	startTestClient(t, newTestClient(ts, "app-1"), func(ctx context.Context, task *Task) (string, error) {
+		if task.TaskType == "fail" {
+			return "", errors.New("boom")
+		}
+		return "echo:" + task.Payload, nil
+	})
+
+	_, result, err := s.RunSingleTask("app-1", "echo", "hello")
+	if err != nil || result != "echo:hello" {
+		t.Fatalf("echo task = %q, %v", result, err)
+	}
+	_, _, err = s.RunSingleTask("app-1", "fail", "")
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) || taskErr.Status != STATUS_FAILED || taskErr.Message != "boom" {
+		t.Fatalf("fail task error = %v", err)
+	}
+}
+
+func TestCloseStopsPolling(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithSingleTimeout(500 * time.Millisecond)
+	c := startTestClient(t, newTestClient(ts, "app-1"), func(ctx context.Context, task *Task) (string, error) {
+		return "done", nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatal("Close:", err)
+	}
+	if _, _, err := s.RunSingleTask("app-1", "echo", ""); err == nil {
+		t.Fatal("task handled after Close")
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal("Err after Close:", err)
+	}
+}
+
+func TestCloseCancelsTasksAtDeadline(t *testing.T) {
+	s, ts := newTestServer(t)
+	started := make(chan struct{})
+	c := startTestClient(t, newTestClient(ts, "app-1"), func(ctx context.Context, task *Task) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "interrupted", nil
+	})
+	taskID, err := s.addTask("app-1", "backup", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = c.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close = %v, want the drain deadline", err)
+	}
+	// the cancelled task reports its status
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if task, err := s.store.GetTask("app-1", taskID); err == nil && task.DoStatus == STATUS_CANCELLED {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("task cancelled at the drain deadline not reported")
+}
+
+func TestRunReturnsFatalError(t *testing.T) {
+	s, ts := newTestServer(t)
+	reported := make(chan error, 1)
+	c := newTestClient(ts, "app-1").SetErrorHandler(func(err error) { reported <- err })
+	startTestClient(t, c, func(ctx context.Context, task *Task) (string, error) { return "", nil })
+
+	// the server no longer knows the client and refuses to register it again without token
+	s.WithLegacyRegistration(false)
+	if err := s.ResetClient("app-1"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || c.Err() == nil {
+			t.Fatalf("Run = %v, Err = %v, want the fatal error", err, c.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return on the fatal error")
+	}
+	if err := <-reported; err == nil {
+		t.Fatal("error handler called without error")
+	}
+}
+
+func TestUnsentResultsFlushed(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+
+	unreachable := httptest.NewServer(nil)
+	unreachable.Close()
+	badGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer badGateway.Close()
+
+	for name, down := range map[string]string{"unreachable": unreachable.URL, "5xx": badGateway.URL} {
+		taskID, err := s.addTask("app-1", "backup", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		task := fetchTestTask(t, c)
+
+		c.SetServerAddr(down)
+		task.Result, task.DoStatus = "done", STATUS_SUCCESS
+		c.pushTaskResult(task)
+
+		c.SetServerAddr(ts.URL)
+		if remaining := c.flushResults(context.Background()); remaining != 0 {
+			t.Fatalf("%s: flushResults remaining = %d", name, remaining)
+		}
+		if stored, err := s.store.GetTask("app-1", taskID); err != nil || stored.DoStatus != STATUS_SUCCESS {
+			t.Fatalf("%s: stored task = %+v, %v", name, stored, err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package forge_connect
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// appIDURI returns the SAN URI naming the appID in a client certificate
+func appIDURI(appID string) *url.URL {
+	return &url.URL{Scheme: "forge", Opaque: appID}
+}
+
+// certificateAppID returns the appID of a client certificate, from its forge:<appID> SAN URI or its common name
+func certificateAppID(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "forge" && uri.Opaque != "" {
+			return uri.Opaque
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// WithAuthMode set how clients authenticate: AUTH_HMAC signatures (default), AUTH_MTLS client
+// certificates, or AUTH_ANY to accept both while migrating. See TLSConfig for the mTLS server setup.
+func (s *Server) WithAuthMode(mode string) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch mode {
+	case AUTH_HMAC, AUTH_MTLS, AUTH_ANY:
+		s.authMode = mode
+	}
+	return s
+}
+
+// WithCA set the certificate authority signing the CSR sent by the clients on registration
+func (s *Server) WithCA(ca *CA) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ca = ca
+	return s
+}
+
+// TLSConfig returns the tls config of the http server for the mTLS auth mode, client certificates
+// are verified against the CA and optional, so that clients without certificate can enroll.
+// It fails without WithCA, the system roots must never authenticate clients.
+func (s *Server) TLSConfig(cert tls.Certificate) (*tls.Config, error) {
+	s.mutex.Lock()
+	ca := s.ca
+	s.mutex.Unlock()
+	if ca == nil {
+		return nil, errors.New("the CA is not set, call WithCA first")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.CertPool(),
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// verifiedClientCert returns the client certificate of the request verified against the CA, nil without
+func (s *Server) verifiedClientCert(r *http.Request) *x509.Certificate {
+	if s.authMode == AUTH_HMAC || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certSerial returns the serial of a certificate as recorded in ClientRecord
+func certSerial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// pemCertSerial returns the serial of a PEM certificate
+func pemCertSerial(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", errors.New("invalid certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return certSerial(cert), nil
+}
+
+// requestCertAppID returns the appID of the verified client certificate of the request. The certificate
+// is only accepted while its serial is the one recorded for the client, so ResetClient revokes it.
+func (s *Server) requestCertAppID(r *http.Request) (appID string, ok bool) {
+	cert := s.verifiedClientCert(r)
+	if cert == nil {
+		return "", false
+	}
+	appID = certificateAppID(cert)
+	if appID == "" {
+		return "", false
+	}
+	info, err := s.store.GetClientInfo(appID)
+	if err != nil || info.CertSerial == "" || info.CertSerial != certSerial(cert) {
+		return "", false
+	}
+	return appID, true
+}
+
+// authenticate reads the request to the api and verifies the client by its certificate or its signature
+func (s *Server) authenticate(r *http.Request, api string) (args requestArgs, err error) {
+	if appID, ok := s.requestCertAppID(r); ok {
+		if args, err = getCertRequestArgs(r, api, appID); err != nil {
+			return
+		}
+		if _, err = s.refreshClientInfo(appID); err != nil {
+			return args, authError("client is not registered")
+		}
+		return
+	}
+	if s.authMode == AUTH_MTLS {
+		return args, authError("client certificate required")
+	}
+	if args, err = getRequestArgs(r, api); err != nil {
+		return
+	}
+	args.ClientIP = s.clientIP(r)
+	if !s.verifySignature(args) {
+		s.authFailed(args)
+		return args, authError("signature verification failed")
+	}
+	return
+}
+
+// authError is a rejected client credential, it is reported with code 4 so that the client registers again,
+// a registration rejected with code 4 stops the client
+type authError string
+
+func (e authError) Error() string {
+	return string(e)
+}
+
+// authErrorCode returns the response code of an authenticate error
+func authErrorCode(err error) int {
+	var authErr authError
+	if errors.As(err, &authErr) {
+		return 4
+	}
+	return 1
+}
+
+// getCertRequestArgs reads the body of a request authenticated by the client certificate of appID
+func getCertRequestArgs(r *http.Request, api, appID string) (args requestArgs, err error) {
+	if headerAppID := r.Header.Get("X-FORGE-APPID"); headerAppID != "" && headerAppID != appID {
+		return args, errors.New("app_id does not match the client certificate")
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return args, errors.New("failed to read request body")
+	}
+	return requestArgs{
+		AppID:   appID,
+		Method:  r.Method,
+		Route:   apiRoutes[api],
+		Payload: string(body),
+	}, nil
+}
+
+// LoadClientCert authenticate with the client certificate and key files in the mTLS auth mode
+func (c *Client) LoadClientCert(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return c.setClientCert(&cert)
+}
+
+// LoadCABundle verify the server certificate with the PEM CA bundle, e.g. the CertPEM of the server CA
+func (c *Client) LoadCABundle(caFile string) error {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New("no certificate found in the CA bundle")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	config, err := c.transportTLS()
+	if err != nil {
+		return err
+	}
+	config.RootCAs = pool
+	return nil
+}
+
+// SetCertEnrollment request a client certificate on Regist when the certificate file does not exist yet,
+// the key is generated locally and the certificate signed by the server CA, both are saved to the files.
+// An existing certificate is loaded instead.
+func (c *Client) SetCertEnrollment(certFile, keyFile string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certFile, c.keyFile = certFile, keyFile
+	return c
+}
+
+// setClientCert use the certificate for the next connections
+func (c *Client) setClientCert(cert *tls.Certificate) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	config, err := c.transportTLS()
+	if err != nil {
+		return err
+	}
+	config.GetClientCertificate = c.getClientCertificate
+	c.clientCert = cert
+	c.HttpClient.Transport.(*http.Transport).CloseIdleConnections()
+	return nil
+}
+
+// getClientCertificate returns the client certificate to the tls handshake
+func (c *Client) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clientCert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return c.clientCert, nil
+}
+
+// transportTLS returns the tls config of the HttpClient transport, the default transport is
+// replaced by a copy so that other http clients are not affected. The caller holds c.mu.
+func (c *Client) transportTLS() (*tls.Config, error) {
+	transport, ok := c.HttpClient.Transport.(*http.Transport)
+	if c.HttpClient.Transport == nil || transport == http.DefaultTransport {
+		transport, ok = http.DefaultTransport.(*http.Transport).Clone(), true
+		c.HttpClient.Transport = transport
+	}
+	if !ok {
+		return nil, errors.New("the transport of HttpClient is not a *http.Transport")
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return transport.TLSClientConfig, nil
+}
+
+// prepareCertEnrollment loads the enrolled certificate, or returns a new key and its CSR to send on registration
+func (c *Client) prepareCertEnrollment() (key *ecdsa.PrivateKey, csrPEM string, err error) {
+	c.mu.Lock()
+	certFile, keyFile := c.certFile, c.keyFile
+	c.mu.Unlock()
+	if certFile == "" {
+		return
+	}
+	if _, statErr := os.Stat(certFile); statErr == nil {
+		return nil, "", c.LoadClientCert(certFile, keyFile)
+	}
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: c.AppID},
+		URIs:    []*url.URL{appIDURI(c.AppID)},
+	}, key)
+	if err != nil {
+		return
+	}
+	csrPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	return
+}
+
+// saveEnrolledCert saves the certificate issued on registration with its key and switches to it
+func (c *Client) saveEnrolledCert(key *ecdsa.PrivateKey, certPEM string) error {
+	if certPEM == "" {
+		return errors.New("server returned no client certificate, is the CA configured?")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair([]byte(certPEM), keyPEM)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	certFile, keyFile := c.certFile, c.keyFile
+	c.mu.Unlock()
+	if err = writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(certFile, []byte(certPEM), 0644); err != nil {
+		return err
+	}
+	return c.setClientCert(&cert)
+}
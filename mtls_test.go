@@ -0,0 +1,211 @@
+package forge_connect
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTLSTestServer returns a server in the auth mode behind an httptest TLS server with a certificate of the CA
+func newTLSTestServer(t *testing.T, ca *CA, mode string) (*Server, *httptest.Server) {
+	s := NewServer("test").
+		WithStore(NewMemoryStore()).
+		WithLegacyRegistration(true).
+		WithCA(ca).
+		WithAuthMode(mode)
+	s.longLoopDuration = 200 * time.Millisecond
+	serverCert, err := ca.IssueServerCert("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(s.Handler())
+	if ts.TLS, err = s.TLSConfig(serverCert); err != nil {
+		t.Fatal(err)
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// newTLSTestClient returns a client of the TLS test server verifying the server certificate with the CA
+func newTLSTestClient(t *testing.T, ts *httptest.Server, ca *CA, appID string) *Client {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.CertPEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(ts, appID)
+	if err := c.LoadCABundle(caFile); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// enrollTestCert registers the client with a CSR like RegistHandler, without starting its polling
+func enrollTestCert(c *Client) error {
+	key, csrPEM, err := c.prepareCertEnrollment()
+	if err != nil {
+		return err
+	}
+	params, _ := json.Marshal(RegistrationRequest{AppID: c.AppID, Secret: c.getSecret(), CSR: csrPEM})
+	resp, _, err := c.SendHTTPRequest("register", string(params))
+	if err != nil {
+		return err
+	}
+	certPEM, _ := resp.(map[string]interface{})["certificate"].(string)
+	return c.saveEnrolledCert(key, certPEM)
+}
+
+func TestCASignCSR(t *testing.T) {
+	ca, err := NewCA("forge clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a CA saved with its key signs the same certificates once loaded
+	if ca, err = LoadCA(ca.CertPEM(), keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	c := NewForge("app-1", "secret").SetCertEnrollment(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	_, csrPEM, err := c.prepareCertEnrollment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ca.SignCSR([]byte(csrPEM), "app-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the CA names the appID it was asked for, not the subject of the CSR
+	if appID := certificateAppID(cert); appID != "app-2" {
+		t.Fatalf("certificate appID = %q, want app-2", appID)
+	}
+	if _, err = cert.Verify(x509.VerifyOptions{
+		Roots:     ca.CertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ca.SignCSR(certPEM, "app-1"); err == nil {
+		t.Fatal("SignCSR accepted a certificate as CSR")
+	}
+}
+
+func TestMTLSAuthentication(t *testing.T) {
+	ca, err := NewCA("forge clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ts := newTLSTestServer(t, ca, AUTH_MTLS)
+
+	// without CSR the registration is rejected in the mTLS auth mode
+	if err = sendRegistration(newTLSTestClient(t, ts, ca, "app-1")); err == nil {
+		t.Fatal("registration without certificate accepted")
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	c := newTLSTestClient(t, ts, ca, "app-1").SetCertEnrollment(certFile, keyFile)
+	if err = enrollTestCert(c); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ping(); err != nil {
+		t.Fatal("ping with the client certificate:", err)
+	}
+
+	// a restarted client loads the saved certificate instead of enrolling again
+	restarted := newTLSTestClient(t, ts, ca, "app-1").SetCertEnrollment(certFile, keyFile)
+	if key, csrPEM, err := restarted.prepareCertEnrollment(); err != nil || key != nil || csrPEM != "" {
+		t.Fatalf("prepareCertEnrollment with a saved certificate = %v, %q, %v", key, csrPEM, err)
+	}
+	if err = restarted.Ping(); err != nil {
+		t.Fatal("ping with the saved certificate:", err)
+	}
+
+	// the signature alone is not accepted, and the certificate names the appID
+	if err = newTLSTestClient(t, ts, ca, "app-1").Ping(); err == nil {
+		t.Fatal("signed request without certificate accepted")
+	}
+	other := newTLSTestClient(t, ts, ca, "app-2")
+	if err = other.LoadClientCert(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Ping(); err == nil {
+		t.Fatal("certificate of app-1 accepted for app-2")
+	}
+}
+
+func TestMTLSAcceptsRecordedCertOnly(t *testing.T) {
+	ca, err := NewCA("forge clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newTLSTestServer(t, ca, AUTH_MTLS)
+	enroll := func() *Client {
+		dir := t.TempDir()
+		c := newTLSTestClient(t, ts, ca, "app-1").SetCertEnrollment(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+		if err := enrollTestCert(c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	old := enroll()
+	renewed := enroll()
+
+	// the enrollment of a new certificate replaces the certificate recorded for the client
+	if err = old.Ping(); err == nil {
+		t.Fatal("replaced certificate accepted")
+	}
+	if err = renewed.Ping(); err != nil {
+		t.Fatal("ping with the recorded certificate:", err)
+	}
+	if err = s.ResetClient("app-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = renewed.Ping(); err == nil {
+		t.Fatal("certificate accepted after ResetClient")
+	}
+}
+
+func TestTLSConfigRequiresCA(t *testing.T) {
+	ca, err := NewCA("forge clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.IssueServerCert("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewServer("test").TLSConfig(serverCert); err == nil {
+		t.Fatal("TLSConfig without CA succeeded")
+	}
+	config, err := NewServer("test").WithCA(ca).TLSConfig(serverCert)
+	if err != nil || config.ClientCAs == nil {
+		t.Fatalf("TLSConfig = %+v, %v", config, err)
+	}
+}
+
+func TestMTLSAuthAnyAcceptsSignatures(t *testing.T) {
+	ca, err := NewCA("forge clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ts := newTLSTestServer(t, ca, AUTH_ANY)
+	c := registerClient(t, newTLSTestClient(t, ts, ca, "app-1"))
+	if err = c.Ping(); err != nil {
+		t.Fatal("signed request rejected in AUTH_ANY:", err)
+	}
+}
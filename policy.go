@@ -0,0 +1,158 @@
+package forge_connect
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TaskPolicy allows task types on the clients matching AppID or Selector, see WithTaskPolicies
+type TaskPolicy struct {
+	PolicyID       string    `json:"policy_id"`
+	AppID          string    `json:"app_id,omitempty"`           // Client of the policy
+	Selector       string    `json:"selector,omitempty"`         // Label selector of the clients, when AppID is empty
+	TaskTypes      []string  `json:"task_types"`                 // Allowed task types, "*" allows any
+	MaxPayloadSize int       `json:"max_payload_size,omitempty"` // Maximum payload length in bytes, 0 is unlimited
+	PayloadPattern string    `json:"payload_pattern,omitempty"`  // Regexp the whole payload must match, empty allows any
+	CreateAt       time.Time `json:"create_at"`
+}
+
+// PolicyError is returned when no task policy allows a task
+type PolicyError struct {
+	AppID    string
+	TaskType string
+	Reason   string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("task type %q is not allowed for %s: %s", e.TaskType, e.AppID, e.Reason)
+}
+
+// WithTaskPolicies enforce the task policies on task submission, a task is rejected with a
+// *PolicyError unless a policy matching the client allows it. The internal forge: tasks of the server bypass them.
+func (s *Server) WithTaskPolicies(enforce bool) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.enforcePolicies = enforce
+	return s
+}
+
+// AddTaskPolicy stores a task policy, returns its policyID
+func (s *Server) AddTaskPolicy(policy TaskPolicy) (policyID string, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	if (policy.AppID == "") == (policy.Selector == "") {
+		return "", errors.New("task policy requires either app_id or selector")
+	}
+	if policy.Selector != "" {
+		if _, err = ParseSelector(policy.Selector); err != nil {
+			return
+		}
+	}
+	if len(policy.TaskTypes) == 0 {
+		return "", errors.New("task policy requires task types")
+	}
+	if policy.PayloadPattern != "" {
+		if _, err = regexp.Compile(policy.PayloadPattern); err != nil {
+			return "", fmt.Errorf("invalid payload pattern: %v", err)
+		}
+	}
+	policy.PolicyID = uuid.New().String()
+	policy.CreateAt = time.Now()
+	if err = s.store.SavePolicy(policy); err != nil {
+		return
+	}
+	return policy.PolicyID, nil
+}
+
+// DeleteTaskPolicy removes a task policy
+func (s *Server) DeleteTaskPolicy(policyID string) (err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	return s.store.DeletePolicy(policyID)
+}
+
+// ListTaskPolicies returns every task policy
+func (s *Server) ListTaskPolicies() (policies []TaskPolicy, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	return s.store.ListPolicies()
+}
+
+// authorizeTask checks the task policies of the client allow the task
+func (s *Server) authorizeTask(appID, taskType, payload string) error {
+	if !s.enforcePolicies {
+		return nil
+	}
+	policies, err := s.store.ListPolicies()
+	if err != nil {
+		return err
+	}
+	var labels map[string]string
+	if clientInfo, err := s.store.GetClientInfo(appID); err == nil {
+		labels = clientInfo.Labels
+	}
+
+	reason := "no task policy matches the client"
+	for _, policy := range policies {
+		if !policy.appliesTo(appID, labels) {
+			continue
+		}
+		if !containsString(policy.TaskTypes, taskType) && !containsString(policy.TaskTypes, "*") {
+			reason = "no task policy allows the task type"
+			continue
+		}
+		if policy.MaxPayloadSize > 0 && len(payload) > policy.MaxPayloadSize {
+			reason = fmt.Sprintf("payload exceeds %d bytes", policy.MaxPayloadSize)
+			continue
+		}
+		if policy.PayloadPattern != "" {
+			matched, err := regexp.MatchString("^(?:"+policy.PayloadPattern+")$", payload)
+			if err != nil || !matched {
+				reason = "payload does not match the policy pattern"
+				continue
+			}
+		}
+		return nil
+	}
+	return &PolicyError{AppID: appID, TaskType: taskType, Reason: reason}
+}
+
+// appliesTo reports whether the policy targets the client
+func (policy TaskPolicy) appliesTo(appID string, labels map[string]string) bool {
+	if policy.AppID != "" {
+		return policy.AppID == appID
+	}
+	sel, err := ParseSelector(policy.Selector)
+	return err == nil && sel.Matches(labels)
+}
+
+// SetAllowedTaskTypes refuse every task type but the given ones, the refused tasks are reported as failed.
+// Without allowlist the client accepts any task type.
+func (c *Client) SetAllowedTaskTypes(taskTypes ...string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.allowedTypes = taskTypes
+	return c
+}
+
+// allowTask checks the task type against the allowlist of the client, internal tasks are always allowed
+func (c *Client) allowTask(task *Task) error {
+	c.mu.Lock()
+	allowed := c.allowedTypes
+	c.mu.Unlock()
+	if allowed == nil || isInternalTask(task.TaskType) || containsString(allowed, task.TaskType) {
+		return nil
+	}
+	consoleLog("ERROR", "task type %s is not allowed, taskID: %s", task.TaskType, task.TaskID)
+	return fmt.Errorf("task type %s is not allowed on this client", task.TaskType)
+}
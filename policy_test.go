@@ -0,0 +1,113 @@
+package forge_connect
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTaskPolicies(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithTaskPolicies(true).WithBroadcastTimeout(200 * time.Millisecond)
+	registerClient(t, newTestClient(ts, "web-1").SetLabels(map[string]string{"role": "web"}))
+	registerClient(t, newTestClient(ts, "db-1").SetLabels(map[string]string{"role": "db"}))
+
+	for _, policy := range []TaskPolicy{
+		{Selector: "role=web", TaskTypes: []string{"deploy"}, MaxPayloadSize: 8, PayloadPattern: `v[0-9]+`},
+		{AppID: "db-1", TaskTypes: []string{"*"}},
+	} {
+		if _, err := s.AddTaskPolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if policies, err := s.ListTaskPolicies(); err != nil || len(policies) != 2 {
+		t.Fatalf("ListTaskPolicies = %+v, %v", policies, err)
+	}
+
+	for _, tt := range []struct {
+		appID    string
+		taskType string
+		payload  string
+		allowed  bool
+	}{
+		{"web-1", "deploy", "v1", true},
+		{"web-1", "restart", "v1", false},
+		{"web-1", "deploy", "latest", false},
+		{"web-1", "deploy", "v123456789", false},
+		{"db-1", "restart", "", true},
+		{"app-x", "deploy", "v1", false},
+	} {
+		_, err := s.pushTask(tt.appID, Task{TaskType: tt.taskType, Payload: tt.payload})
+		var policyErr *PolicyError
+		if tt.allowed && err != nil || !tt.allowed && !errors.As(err, &policyErr) {
+			t.Errorf("%s %s %q: pushTask error = %v", tt.appID, tt.taskType, tt.payload, err)
+		}
+	}
+
+	if _, err := s.ScheduleTask(ScheduledTask{AppID: "web-1", TaskType: "restart", RunAt: time.Now().Add(time.Hour)}); err == nil {
+		t.Error("ScheduleTask of a task type not allowed succeeded")
+	}
+	// a refused client of a broadcast is reported, the others still receive the task
+	results, err := s.RunBroadcastTask([]string{"web-1", "db-1"}, "restart", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results["web-1"]; r.Status != STATUS_FAILED || r.TaskID != "" {
+		t.Errorf("web-1 result = %+v", r)
+	}
+	if r := results["db-1"]; r.Status != STATUS_TIMEOUT || r.TaskID == "" {
+		t.Errorf("db-1 result = %+v", r)
+	}
+}
+
+func TestAddTaskPolicyValidation(t *testing.T) {
+	s := NewServer("test").WithStore(NewMemoryStore())
+	for name, policy := range map[string]TaskPolicy{
+		"no target":       {TaskTypes: []string{"deploy"}},
+		"two targets":     {AppID: "web-1", Selector: "role=web", TaskTypes: []string{"deploy"}},
+		"no task type":    {AppID: "web-1"},
+		"invalid pattern": {AppID: "web-1", TaskTypes: []string{"deploy"}, PayloadPattern: "("},
+	} {
+		if _, err := s.AddTaskPolicy(policy); err == nil {
+			t.Errorf("%s: AddTaskPolicy succeeded", name)
+		}
+	}
+	policyID, err := s.AddTaskPolicy(TaskPolicy{AppID: "web-1", TaskTypes: []string{"deploy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteTaskPolicy(policyID); err != nil {
+		t.Fatal(err)
+	}
+	if policies, _ := s.ListTaskPolicies(); len(policies) != 0 {
+		t.Fatalf("policies after delete = %+v", policies)
+	}
+}
+
+func TestClientAllowedTaskTypes(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1").SetAllowedTaskTypes("deploy")
+	var handled []string
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		handled = append(handled, task.TaskType)
+		return "", nil
+	}
+	for _, taskType := range []string{"restart", "deploy"} {
+		taskID, err := s.pushTask("app-1", Task{TaskType: taskType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.runTask(fetchTestTask(t, c))
+		want := STATUS_SUCCESS
+		if taskType == "restart" {
+			want = STATUS_FAILED
+		}
+		if stored, err := s.store.GetTask("app-1", taskID); err != nil || stored.DoStatus != want {
+			t.Errorf("%s task = %+v, %v, want %s", taskType, stored, err, want)
+		}
+	}
+	if len(handled) != 1 || handled[0] != "deploy" {
+		t.Fatalf("handled task types = %v", handled)
+	}
+}
@@ -0,0 +1,193 @@
+package forge_connect
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultMaxQueued is the default limit of the tasks waiting for their task type slot, see SetMaxQueued
+const defaultMaxQueued = 100
+
+// ClientStats are the task execution metrics of the client
+type ClientStats struct {
+	MaxConcurrency int            `json:"max_concurrency"` // 0 means unlimited
+	Running        int            `json:"running"`         // Tasks in their handler
+	Queued         int            `json:"queued"`          // Fetched tasks waiting for a slot of their task type
+	RunningByType  map[string]int `json:"running_by_type"`
+	QueuedByType   map[string]int `json:"queued_by_type"`
+	Completed      int64          `json:"completed"`
+	Saturated      int64          `json:"saturated"`  // Times a worker was needed while every worker was busy
+	QueueWait      time.Duration  `json:"queue_wait"` // Total wait of the tasks for a slot of their task type
+}
+
+// SetConcurrency limits the tasks handled at the same time, 0 means unlimited.
+// The client stops polling getTask while every worker is busy. Call it before Regist.
+func (c *Client) SetConcurrency(max int) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workers = nil
+	if max > 0 {
+		c.workers = make(chan struct{}, max)
+	}
+	c.stats.MaxConcurrency = max
+	return c
+}
+
+// SetMaxQueued limits the fetched tasks waiting for a slot of their task type, the client stops polling
+// getTask while the queue is full. 100 by default, 0 means unlimited. Call it before Regist.
+func (c *Client) SetMaxQueued(max int) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max >= 0 {
+		c.maxQueued = max
+	}
+	return c
+}
+
+// SetTaskTypeConcurrency limits the tasks of the type handled at the same time, 0 means unlimited.
+// Further tasks of the type wait in the client without holding a worker, so that the other task types
+// keep running, and take a worker again with their slot, see SetConcurrency. Call it before Regist.
+func (c *Client) SetTaskTypeConcurrency(taskType string, max int) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.typeWorkers, taskType)
+	if max > 0 {
+		c.typeWorkers[taskType] = make(chan struct{}, max)
+	}
+	return c
+}
+
+// Stats returns the task execution metrics of the client
+func (c *Client) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.RunningByType = make(map[string]int, len(c.stats.RunningByType))
+	for taskType, count := range c.stats.RunningByType {
+		stats.RunningByType[taskType] = count
+	}
+	stats.QueuedByType = make(map[string]int, len(c.stats.QueuedByType))
+	for taskType, count := range c.stats.QueuedByType {
+		stats.QueuedByType[taskType] = count
+	}
+	return stats
+}
+
+// acquireWorker waits for a free worker until the client is closed, release frees the worker and may be called twice
+func (c *Client) acquireWorker() (release func(), ok bool) {
+	c.mu.Lock()
+	workers := c.workers
+	c.mu.Unlock()
+	if workers == nil {
+		return func() {}, c.ctx.Err() == nil
+	}
+	select {
+	case workers <- struct{}{}:
+	default:
+		c.mu.Lock()
+		c.stats.Saturated++
+		c.mu.Unlock()
+		if c.IsDebug {
+			consoleLog("DEBUG", "all %d workers are busy, polling paused.", cap(workers))
+		}
+		select {
+		case workers <- struct{}{}:
+		case <-c.ctx.Done():
+			return nil, false
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-workers })
+	}, true
+}
+
+// waitQueueRoom waits until the queue of the tasks waiting for their task type slot is not full,
+// it returns false when the client is closed before
+func (c *Client) waitQueueRoom() bool {
+	for c.ctx.Err() == nil {
+		c.mu.Lock()
+		full := c.maxQueued > 0 && c.stats.Queued >= c.maxQueued
+		c.mu.Unlock()
+		if !full {
+			return true
+		}
+		c.sleep(c.taskInterval)
+	}
+	return false
+}
+
+// runQueued waits for a slot of the task type and runs the task holding the worker freed by release,
+// a task still waiting when the client is closed is not run. startTask counted the task as queued.
+func (c *Client) runQueued(task *Task, release func()) {
+	defer func() { release() }()
+	taskType := task.TaskType
+	c.mu.Lock()
+	slots := c.typeWorkers[taskType]
+	c.mu.Unlock()
+
+	start := time.Now()
+	acquired := c.acquireTypeSlot(slots, &release)
+	if acquired && slots != nil {
+		defer func() { <-slots }()
+	}
+	started := acquired && c.ctx.Err() == nil
+
+	c.mu.Lock()
+	c.stats.Queued--
+	decrement(c.stats.QueuedByType, taskType)
+	if started {
+		c.stats.Running++
+		c.stats.RunningByType[taskType]++
+		c.stats.QueueWait += time.Since(start)
+	}
+	c.mu.Unlock()
+	if !started {
+		consoleLog("INFO", "client closed before the task started, taskID: %s", task.TaskID)
+		return
+	}
+
+	c.execTask(task)
+
+	c.mu.Lock()
+	c.stats.Running--
+	decrement(c.stats.RunningByType, taskType)
+	c.stats.Completed++
+	c.mu.Unlock()
+}
+
+// acquireTypeSlot takes a slot of the task type, nil slots are unlimited. The worker is released while
+// waiting for the slot and acquired again once it is free, release is replaced by the new worker release.
+// It returns false when the client is closed before.
+func (c *Client) acquireTypeSlot(slots chan struct{}, release *func()) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	(*release)()
+	select {
+	case slots <- struct{}{}:
+	case <-c.ctx.Done():
+		return false
+	}
+	workerRelease, ok := c.acquireWorker()
+	if !ok {
+		<-slots
+		return false
+	}
+	*release = workerRelease
+	return true
+}
+
+// decrement decrements the counter of the key, dropping it at zero
+func decrement(counters map[string]int, key string) {
+	if counters[key] <= 1 {
+		delete(counters, key)
+		return
+	}
+	counters[key]--
+}
@@ -0,0 +1,178 @@
+package forge_connect
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingHandler blocks the tasks until release is closed and records the peak of concurrent tasks
+type blockingHandler struct {
+	release chan struct{}
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (h *blockingHandler) handle(ctx context.Context, task *Task) (string, error) {
+	h.mu.Lock()
+	h.running++
+	if h.running > h.peak {
+		h.peak = h.running
+	}
+	h.mu.Unlock()
+	<-h.release
+	h.mu.Lock()
+	h.running--
+	h.mu.Unlock()
+	return "done", nil
+}
+
+// waitForStats waits until the stats of the client satisfy cond
+func waitForStats(t *testing.T, c *Client, cond func(ClientStats) bool) ClientStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats := c.Stats(); cond(stats) {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("stats not reached: %+v", c.Stats())
+	return ClientStats{}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	s, ts := newTestServer(t)
+	h := &blockingHandler{release: make(chan struct{})}
+	c := startTestClient(t, newTestClient(ts, "app-1").SetConcurrency(2), h.handle)
+	for i := 0; i < 5; i++ {
+		if _, err := s.addTask("app-1", "echo", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the busy client stops polling, the other tasks stay on the server
+	stats := waitForStats(t, c, func(stats ClientStats) bool { return stats.Running == 2 && stats.Saturated > 0 })
+	if stats.MaxConcurrency != 2 || stats.RunningByType["echo"] != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if delivered, _ := s.store.ListProcessing("app-1"); len(delivered) != 2 {
+		t.Fatalf("tasks delivered = %d, want 2", len(delivered))
+	}
+
+	close(h.release)
+	waitForStats(t, c, func(stats ClientStats) bool { return stats.Completed == 5 })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.peak != 2 {
+		t.Fatalf("peak of concurrent tasks = %d, want 2", h.peak)
+	}
+}
+
+func TestTaskTypeConcurrency(t *testing.T) {
+	s, ts := newTestServer(t)
+	h := &blockingHandler{release: make(chan struct{})}
+	c := startTestClient(t, newTestClient(ts, "app-1").SetTaskTypeConcurrency("backup", 1), h.handle)
+	for _, taskType := range []string{"backup", "backup", "echo"} {
+		if _, err := s.addTask("app-1", taskType, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := waitForStats(t, c, func(stats ClientStats) bool { return stats.Running == 2 && stats.Queued == 1 })
+	if stats.RunningByType["backup"] != 1 || stats.RunningByType["echo"] != 1 || stats.QueuedByType["backup"] != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	close(h.release)
+	stats = waitForStats(t, c, func(stats ClientStats) bool { return stats.Completed == 3 })
+	if stats.Queued != 0 || len(stats.QueuedByType) != 0 || stats.QueueWait <= 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestQueuedTaskReleasesWorker(t *testing.T) {
+	s, ts := newTestServer(t)
+	h := &blockingHandler{release: make(chan struct{})}
+	c := startTestClient(t, newTestClient(ts, "app-1").SetConcurrency(2).SetTaskTypeConcurrency("backup", 1), h.handle)
+	for _, taskType := range []string{"backup", "backup", "backup", "echo"} {
+		if _, err := s.addTask("app-1", taskType, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the backups waiting for their slot leave the second worker to the echo task
+	stats := waitForStats(t, c, func(stats ClientStats) bool { return stats.Running == 2 && stats.Queued == 2 })
+	if stats.RunningByType["backup"] != 1 || stats.RunningByType["echo"] != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	close(h.release)
+	waitForStats(t, c, func(stats ClientStats) bool { return stats.Completed == 4 })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.peak != 2 {
+		t.Fatalf("peak of concurrent tasks = %d, want 2", h.peak)
+	}
+}
+
+func TestMaxQueuedPausesPolling(t *testing.T) {
+	s, ts := newTestServer(t)
+	h := &blockingHandler{release: make(chan struct{})}
+	c := startTestClient(t, newTestClient(ts, "app-1").SetTaskTypeConcurrency("backup", 1).SetMaxQueued(2), h.handle)
+	for i := 0; i < 6; i++ {
+		if _, err := s.addTask("app-1", "backup", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one backup runs and two wait for the slot, the other tasks stay on the server
+	waitForStats(t, c, func(stats ClientStats) bool { return stats.Running == 1 && stats.Queued == 2 })
+	time.Sleep(100 * time.Millisecond)
+	if delivered, _ := s.store.ListProcessing("app-1"); len(delivered) != 3 {
+		t.Fatalf("tasks delivered = %d, want 3", len(delivered))
+	}
+
+	close(h.release)
+	waitForStats(t, c, func(stats ClientStats) bool { return stats.Completed == 6 })
+}
+
+func TestCancelQueuedTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handled := map[string]bool{}
+	c := startTestClient(t, newTestClient(ts, "app-1").SetTaskTypeConcurrency("backup", 1), func(ctx context.Context, task *Task) (string, error) {
+		mu.Lock()
+		handled[task.Payload] = true
+		mu.Unlock()
+		<-release
+		return "done", nil
+	})
+	if _, err := s.addTask("app-1", "backup", "first"); err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, c, func(stats ClientStats) bool { return stats.Running == 1 })
+	queuedID, err := s.addTask("app-1", "backup", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, c, func(stats ClientStats) bool { return stats.Queued == 1 })
+
+	// the cancel signal of the next ping reaches the task waiting for its slot
+	if err = s.CancelTask("app-1", queuedID); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	waitForStats(t, c, func(stats ClientStats) bool { return stats.Running == 0 && stats.Queued == 0 })
+	mu.Lock()
+	defer mu.Unlock()
+	if !handled["first"] || handled["second"] {
+		t.Fatalf("handled tasks = %v, want the first one only", handled)
+	}
+}
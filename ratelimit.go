@@ -0,0 +1,158 @@
+package forge_connect
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rate limit and lockout scopes
+const (
+	scopeApp = "app"
+	scopeIP  = "ip"
+)
+
+// RateLimit allows Requests per Window, the zero RateLimit is unlimited
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+type apiRateLimit struct {
+	perApp RateLimit
+	perIP  RateLimit
+}
+
+// lockoutPolicy locks an appID or IP out after MaxFailures failed authentications within Window
+type lockoutPolicy struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+}
+
+// WithRateLimit limit the requests to the api ("register", "ping", "getTask", "reportTask" or "reportMessage")
+// per appID and per source IP. The counters are kept in the store, so the limits hold across replicas.
+func (s *Server) WithRateLimit(api string, perApp, perIP RateLimit) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rateLimits == nil {
+		s.rateLimits = make(map[string]apiRateLimit)
+	}
+	s.rateLimits[api] = apiRateLimit{perApp: perApp, perIP: perIP}
+	return s
+}
+
+// WithLockout lock the source IP out for the duration after maxFailures failed signature or enrollment
+// checks within the window. The appID of a failed request is not authenticated, so it is never locked out.
+func (s *Server) WithLockout(maxFailures int, window, duration time.Duration) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if maxFailures > 0 && window > 0 && duration > 0 {
+		s.lockout = &lockoutPolicy{maxFailures: maxFailures, window: window, duration: duration}
+	}
+	return s
+}
+
+// WithClientIPHeader read the source IP from the header set by a trusted reverse proxy, e.g. "X-Real-IP".
+// For a list like X-Forwarded-For the rightmost address is used, the one appended by the proxy itself.
+func (s *Server) WithClientIPHeader(header string) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clientIPHeader = header
+	return s
+}
+
+// clientIP returns the source IP of the request
+func (s *Server) clientIP(r *http.Request) string {
+	if s.clientIPHeader != "" {
+		// the addresses left of the one appended by the trusted proxy are set by the client
+		if values := r.Header.Values(s.clientIPHeader); len(values) > 0 {
+			chain := strings.Split(values[len(values)-1], ",")
+			if value := strings.TrimSpace(chain[len(chain)-1]); value != "" {
+				return value
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limit wraps the api handler with the lockout check and the rate limits
+func (s *Server) limit(api string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.store == nil || (s.lockout == nil && s.rateLimits[api] == (apiRateLimit{})) {
+			next(w, r)
+			return
+		}
+		ip := s.clientIP(r)
+		appID, ok := s.requestCertAppID(r)
+		if !ok {
+			appID = r.Header.Get("X-FORGE-APPID")
+		}
+
+		if s.lockout != nil && ip != "" {
+			locked, err := s.store.IsLockedOut(scopeIP, ip)
+			if err != nil {
+				consoleRouter("[ERROR]", fmt.Sprintf("IsLockedOut error: %v", err))
+			}
+			if locked {
+				s.tooManyRequests(w, s.lockout.duration, "too many failed authentications, try again later")
+				return
+			}
+		}
+
+		limits := s.rateLimits[api]
+		for _, scope := range []struct {
+			name, id string
+			limit    RateLimit
+		}{{scopeIP, ip, limits.perIP}, {scopeApp, appID, limits.perApp}} {
+			if scope.id == "" || scope.limit.Requests <= 0 || scope.limit.Window <= 0 {
+				continue
+			}
+			count, err := s.store.IncrRequestCount(api, scope.name, scope.id, scope.limit.Window)
+			if err != nil {
+				consoleRouter("[ERROR]", fmt.Sprintf("IncrRequestCount error: %v", err))
+				continue
+			}
+			if count > int64(scope.limit.Requests) {
+				s.tooManyRequests(w, scope.limit.Window, "rate limit exceeded")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// authFailed counts a failed authentication of the source IP and locks it out once the failures reach
+// the lockout threshold. The appID named by the request is not counted, anyone could name it.
+func (s *Server) authFailed(args requestArgs) {
+	if s.lockout == nil || args.ClientIP == "" {
+		return
+	}
+	failures, err := s.store.IncrAuthFailure(scopeIP, args.ClientIP, s.lockout.window)
+	if err != nil {
+		consoleRouter("[ERROR]", fmt.Sprintf("IncrAuthFailure error: %v", err))
+		return
+	}
+	if failures >= int64(s.lockout.maxFailures) {
+		consoleLog("ERROR", "lockout %s %s after %d failed authentications", scopeIP, args.ClientIP, failures)
+		if err = s.store.SetLockout(scopeIP, args.ClientIP, s.lockout.duration); err != nil {
+			consoleRouter("[ERROR]", fmt.Sprintf("SetLockout error: %v", err))
+		}
+	}
+}
+
+// tooManyRequests rejects the request with HTTP 429 and code 3
+func (s *Server) tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.FormatInt(expireSeconds(retryAfter), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(Response{Code: 3, Message: message})
+}
@@ -0,0 +1,109 @@
+package forge_connect
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithRateLimit("ping", RateLimit{Requests: 2, Window: time.Minute}, RateLimit{Requests: 4, Window: time.Minute})
+	c1 := registerTestClient(t, ts, "app-1")
+	c2 := registerTestClient(t, ts, "app-2")
+
+	for i, tt := range []struct {
+		client  *Client
+		limited bool
+	}{
+		{c1, false},
+		{c1, false},
+		{c1, true}, // per app limit
+		{c2, false},
+		{c2, true}, // per IP limit, every client connects from 127.0.0.1
+	} {
+		_, errno, err := tt.client.SendHTTPRequest("ping", "ping")
+		if limited := err != nil && errno == 3; limited != tt.limited || !limited && err != nil {
+			t.Errorf("request %d of %s: errno = %d, %v, want limited %v", i, tt.client.AppID, errno, err, tt.limited)
+		}
+	}
+	// the other apis have their own limits
+	if _, errno, _ := c1.GetTask(); errno != 2 {
+		t.Fatalf("getTask: errno = %d, want 2", errno)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLockout(3, time.Minute, time.Minute)
+	c := registerTestClient(t, ts, "app-1")
+	attacker := NewForge("app-1", "guessed").SetServerAddr(ts.URL)
+
+	for i := 0; i < 3; i++ {
+		if _, errno, err := attacker.SendHTTPRequest("ping", "ping"); err == nil || errno == 3 {
+			t.Fatalf("failed authentication %d: errno = %d, %v", i, errno, err)
+		}
+	}
+	if _, errno, _ := attacker.SendHTTPRequest("ping", "ping"); errno != 3 {
+		t.Fatalf("request after the lockout: errno = %d, want 3", errno)
+	}
+	// the source IP is locked out as well
+	if _, errno, _ := c.SendHTTPRequest("ping", "ping"); errno != 3 {
+		t.Fatalf("request from the locked out IP: errno = %d, want 3", errno)
+	}
+	if locked, err := s.store.IsLockedOut(scopeIP, "127.0.0.1"); err != nil || !locked {
+		t.Errorf("ip locked out = %v, %v", locked, err)
+	}
+
+	// the appID named by the attacker is not locked out, the client pings from another IP
+	if locked, err := s.store.IsLockedOut(scopeApp, "app-1"); err != nil || locked {
+		t.Errorf("app locked out = %v, %v", locked, err)
+	}
+	dateTime, nonce := TimeFormat(time.Now()), randomHex(16)
+	r := httptest.NewRequest("POST", apiRoutes["ping"], strings.NewReader("ping"))
+	r.RemoteAddr = "192.0.2.7:4321"
+	r.Header.Set("X-FORGE-APPID", c.AppID)
+	r.Header.Set("X-FORGE-TIME", dateTime)
+	r.Header.Set("X-FORGE-NONCE", nonce)
+	r.Header.Set("X-FORGE-SIGN", c.generateSignature("ping", dateTime, nonce, "ping"))
+	r.Header.Set("X-FORGE-SIGN-VERSION", SIGN_V2)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	var body Response
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusOK || body.Code != 0 {
+		t.Fatalf("ping from another IP = %d %+v, %v", w.Code, body, err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s := NewServer("test")
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("X-Real-IP", "192.0.2.7")
+	if ip := s.clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("clientIP without trusted header = %q", ip)
+	}
+	s.WithClientIPHeader("X-Real-IP")
+	if ip := s.clientIP(r); ip != "192.0.2.7" {
+		t.Errorf("clientIP with trusted header = %q", ip)
+	}
+	r.Header.Del("X-Real-IP")
+	if ip := s.clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("clientIP without the header value = %q", ip)
+	}
+
+	// the client sets the left part of a forwarded chain, the proxy appends the address it saw
+	s.WithClientIPHeader("X-Forwarded-For")
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 192.0.2.7")
+	if ip := s.clientIP(r); ip != "192.0.2.7" {
+		t.Errorf("clientIP of a forwarded chain = %q", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "1.1.1.1")
+	r.Header.Add("X-Forwarded-For", "192.0.2.8")
+	if ip := s.clientIP(r); ip != "192.0.2.8" {
+		t.Errorf("clientIP of repeated headers = %q", ip)
+	}
+}
@@ -0,0 +1,179 @@
+package forge_connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// StartReaper runs ReapTasks every interval until ctx is done.
+// The store must outlive a single http request, e.g. WithStore(NewRedisPoolStore(pool)).
+func (s *Server) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				consoleLog("INFO", "task reaper stopped.")
+				return
+			case <-ticker.C:
+				requeued, dead, err := s.ReapTasks()
+				if err != nil {
+					consoleLog("ERROR", "task reaper error: %v", err)
+				}
+				if s.IsDebug && requeued+dead > 0 {
+					consoleLog("DEBUG", "task reaper requeued: %d, dead: %d", requeued, dead)
+				}
+			}
+		}
+	}()
+}
+
+// ReapTasks scans the processing queue of every registered client once.
+// A task whose lock expired without a terminal status is requeued, or moved to the
+// dead-letter queue when it was already delivered max attempts times.
+func (s *Server) ReapTasks() (requeued, dead int, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	appIDs, err := s.store.ListClientIDs()
+	if err != nil {
+		return
+	}
+	for _, appID := range appIDs {
+		taskIDs, err := s.store.ListProcessing(appID)
+		if err != nil {
+			return requeued, dead, err
+		}
+		for _, taskID := range taskIDs {
+			status, err := s.reapTask(appID, taskID)
+			if err != nil {
+				return requeued, dead, err
+			}
+			switch status {
+			case STATUS_DOING:
+				requeued++
+			case STATUS_DEAD:
+				dead++
+			}
+		}
+	}
+	return
+}
+
+// reapTask check a task of the processing queue, it returns STATUS_DOING when the task is requeued
+// and STATUS_DEAD when it is moved to the dead-letter queue
+func (s *Server) reapTask(appID, taskID string) (status string, err error) {
+	task, err := s.store.GetTask(appID, taskID)
+	if errors.Is(err, ErrNotFound) {
+		// the task record expired
+		_, err = s.store.RemoveProcessing(appID, taskID)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if task.DoStatus != "" && task.DoStatus != STATUS_DOING {
+		_, err = s.store.RemoveProcessing(appID, taskID)
+		return
+	}
+
+	locked, err := s.store.HasLock(appID, taskID)
+	if err != nil || locked {
+		return
+	}
+	deliverAt := task.DeliverAt
+	if deliverAt.IsZero() {
+		deliverAt = task.CreateAt
+	}
+	if time.Since(deliverAt) < s.lockTimeout {
+		// popped a moment ago, the lock is not acquired yet
+		return
+	}
+
+	// only the replica removing the task from the processing queue handles it
+	removed, err := s.store.RemoveProcessing(appID, taskID)
+	if err != nil || !removed {
+		return
+	}
+
+	if task.Attempts < s.maxAttempts {
+		if err = s.store.PushTask(appID, taskID, task.Priority); err != nil {
+			return
+		}
+		if s.IsDebug {
+			log.Println("[DEBUG] requeue task:", appID, taskID, task.Attempts)
+		}
+		return STATUS_DOING, nil
+	}
+
+	task.DoStatus = STATUS_DEAD
+	task.Error = fmt.Sprintf("task lock expired after %d attempts", task.Attempts)
+	if err = s.store.SaveTask(appID, task, RDX_EXPIRE*time.Second); err != nil {
+		return
+	}
+	if err = s.store.PushDeadTask(appID, taskID); err != nil {
+		return
+	}
+	if s.IsDebug {
+		log.Println("[DEBUG] dead task:", appID, taskID)
+	}
+	return STATUS_DEAD, s.store.PushResult(appID, task, RESULT_EXPIRE*time.Second)
+}
+
+// ListDeadTasks returns the tasks of the dead-letter queue of a client
+func (s *Server) ListDeadTasks(appID string) (tasks []Task, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	taskIDs, err := s.store.ListDeadTasks(appID)
+	if err != nil {
+		return
+	}
+	for _, taskID := range taskIDs {
+		task, err := s.store.GetTask(appID, taskID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// a task sealed with an outdated secret stays encrypted
+		_ = s.openTask(appID, &task)
+		tasks = append(tasks, task)
+	}
+	return
+}
+
+// ReplayDeadTask move a task of the dead-letter queue back to the task queue with a fresh attempt counter
+func (s *Server) ReplayDeadTask(appID, taskID string) (err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	task, err := s.store.GetTask(appID, taskID)
+	if err != nil {
+		return
+	}
+	removed, err := s.store.RemoveDeadTask(appID, taskID)
+	if err != nil {
+		return
+	}
+	if !removed {
+		return fmt.Errorf("task %s is not in the dead-letter queue", taskID)
+	}
+
+	task.DoStatus = ""
+	task.Error = ""
+	task.Attempts = 0
+	task.DeliverAt = time.Time{}
+	if err = s.store.SaveTask(appID, task, RDX_EXPIRE*time.Second); err != nil {
+		return
+	}
+	return s.store.PushTask(appID, taskID, task.Priority)
+}
@@ -0,0 +1,130 @@
+package forge_connect
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReapTasksRedeliversThenDeadLetters(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLockTimeout(50 * time.Millisecond).WithMaxAttempts(2)
+	c := registerTestClient(t, ts, "app-1")
+	taskID, err := s.addTask("app-1", "backup", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reap := func() (requeued, dead int) {
+		time.Sleep(100 * time.Millisecond)
+		requeued, dead, err := s.ReapTasks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return requeued, dead
+	}
+	if task := fetchTestTask(t, c); task.TaskID != taskID || task.Attempts != 1 {
+		t.Fatalf("first delivery = %+v", task)
+	}
+	if requeued, dead := reap(); requeued != 1 || dead != 0 {
+		t.Fatalf("ReapTasks after the first delivery = %d requeued, %d dead", requeued, dead)
+	}
+	if task := fetchTestTask(t, c); task.TaskID != taskID || task.Attempts != 2 {
+		t.Fatalf("second delivery = %+v", task)
+	}
+	if requeued, dead := reap(); requeued != 0 || dead != 1 {
+		t.Fatalf("ReapTasks after the last attempt = %d requeued, %d dead", requeued, dead)
+	}
+
+	tasks, err := s.ListDeadTasks("app-1")
+	if err != nil || len(tasks) != 1 || tasks[0].TaskID != taskID || tasks[0].DoStatus != STATUS_DEAD {
+		t.Fatalf("ListDeadTasks = %+v, %v", tasks, err)
+	}
+	if err = s.ReplayDeadTask("app-1", taskID); err != nil {
+		t.Fatal(err)
+	}
+	if task := fetchTestTask(t, c); task.TaskID != taskID || task.Attempts != 1 {
+		t.Fatalf("replayed delivery = %+v", task)
+	}
+	if err = s.ReplayDeadTask("app-1", taskID); err == nil {
+		t.Fatal("ReplayDeadTask of a task outside the dead-letter queue succeeded")
+	}
+}
+
+func TestDeadTaskReportedToWaiter(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLockTimeout(50 * time.Millisecond).WithMaxAttempts(1)
+	c := registerTestClient(t, ts, "app-1")
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.RunSingleTask("app-1", "backup", "")
+		done <- err
+	}()
+	fetchTestTask(t, c)
+	time.Sleep(100 * time.Millisecond)
+	if _, dead, err := s.ReapTasks(); err != nil || dead != 1 {
+		t.Fatalf("ReapTasks = %d dead, %v", dead, err)
+	}
+
+	select {
+	case err := <-done:
+		var taskErr *TaskError
+		if !errors.As(err, &taskErr) || taskErr.Status != STATUS_DEAD {
+			t.Fatalf("RunSingleTask of a dead task = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead task not reported to the waiter")
+	}
+}
+
+func TestPingExtendsDeliveryLocks(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLockTimeout(150 * time.Millisecond)
+	c := registerTestClient(t, ts, "app-1")
+	if _, err := s.addTask("app-1", "backup", ""); err != nil {
+		t.Fatal(err)
+	}
+	task := fetchTestTask(t, c)
+	c.delivered[task.TaskID]++
+
+	// the task outlives its lock timeout, the pings keep it locked
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if err := c.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requeued, dead, err := s.ReapTasks(); err != nil || requeued != 0 || dead != 0 {
+		t.Fatalf("ReapTasks of a pinged task = %d requeued, %d dead, %v", requeued, dead, err)
+	}
+
+	delete(c.delivered, task.TaskID)
+	time.Sleep(200 * time.Millisecond)
+	if requeued, _, err := s.ReapTasks(); err != nil || requeued != 1 {
+		t.Fatalf("ReapTasks after the task left the client = %d requeued, %v", requeued, err)
+	}
+}
+
+func TestReapTasksKeepsLockedAndFinishedTasks(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLockTimeout(time.Minute)
+	c := registerTestClient(t, ts, "app-1")
+	if _, err := s.addTask("app-1", "backup", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.addTask("app-1", "restore", ""); err != nil {
+		t.Fatal(err)
+	}
+	fetchTestTask(t, c)
+	done := fetchTestTask(t, c)
+	done.Result, done.DoStatus = "ok", STATUS_SUCCESS
+	c.pushTaskResult(done)
+
+	if requeued, dead, err := s.ReapTasks(); err != nil || requeued+dead != 0 {
+		t.Fatalf("ReapTasks = %d requeued, %d dead, %v", requeued, dead, err)
+	}
+	if processing, _ := s.store.ListProcessing("app-1"); len(processing) != 1 {
+		t.Fatalf("processing queue = %v, want the locked task only", processing)
+	}
+}
@@ -0,0 +1,74 @@
+package forge_connect
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxReconnectInterval caps the backoff between the registration attempts, in seconds
+const maxReconnectInterval = 300
+
+// OnStateChange set the callback of the connection state changes, see the STATE_ constants.
+// It is called synchronously by the polling and health check goroutines and must not block.
+func (c *Client) OnStateChange(callback func(from, to string)) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onStateChange = callback
+	return c
+}
+
+// State returns the connection state of the client
+func (c *Client) State() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// setState changes the connection state and notifies the OnStateChange callback
+func (c *Client) setState(state string) {
+	c.mu.Lock()
+	from := c.state
+	c.state = state
+	callback := c.onStateChange
+	c.mu.Unlock()
+	if from == state {
+		return
+	}
+	consoleLog("INFO", "connection state %s -> %s", from, state)
+	if callback != nil {
+		callback(from, state)
+	}
+}
+
+// reconnect registers the client again with backoff until it succeeds, the client is closed,
+// or the server rejects its credentials (code 4), which stops the client with a fatal error.
+// A client whose record the server lost needs a new enrollment token, it cannot recover here.
+// A failure observed before the last successful registration (since) is already recovered.
+func (c *Client) reconnect(since time.Time, reason error) {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+	c.mu.Lock()
+	recovered := c.registeredAt.After(since)
+	c.mu.Unlock()
+	if recovered || c.ctx.Err() != nil {
+		return
+	}
+
+	consoleLog("ERROR", "connection lost: %v, registering again", reason)
+	for attempt := 1; c.ctx.Err() == nil; attempt++ {
+		_, errno, err := c.register()
+		if err == nil {
+			return
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+		if errno == 4 {
+			c.fail(fmt.Errorf("register again: %v", err))
+			return
+		}
+		interval := fibonacciBackoff(attempt, maxReconnectInterval)
+		consoleLog("ERROR", "register again error: %v, attempt: %d, retry in %ds", err, attempt, interval)
+		c.sleep(time.Duration(interval) * time.Second)
+	}
+}
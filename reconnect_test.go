@@ -0,0 +1,136 @@
+package forge_connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stateRecorder records the connection state changes of a client
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []string
+}
+
+func (r *stateRecorder) record(from, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, to)
+}
+
+// waitFor waits until the client reached the state count times
+func (r *stateRecorder) waitFor(t *testing.T, state string, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		seen := 0
+		for _, s := range r.states {
+			if s == state {
+				seen++
+			}
+		}
+		r.mu.Unlock()
+		if seen >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.Fatalf("state %s not reached %d times, states: %v", state, count, r.states)
+}
+
+func TestReconnectAfterLostRegistration(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithSingleTimeout(5 * time.Second)
+	states := &stateRecorder{}
+	c := newTestClient(ts, "app-1").OnStateChange(states.record)
+	startTestClient(t, c, func(ctx context.Context, task *Task) (string, error) {
+		return "echo:" + task.Payload, nil
+	})
+	states.waitFor(t, STATE_REGISTERED, 1)
+
+	// the server lost the client, its next poll is rejected with code 4 and it registers again
+	if err := s.ResetClient("app-1"); err != nil {
+		t.Fatal(err)
+	}
+	states.waitFor(t, STATE_REGISTERED, 2)
+	if _, result, err := s.RunSingleTask("app-1", "echo", "again"); err != nil || result != "echo:again" {
+		t.Fatalf("task after the reconnect = %q, %v", result, err)
+	}
+	if c.Err() != nil || c.State() != STATE_REGISTERED {
+		t.Fatalf("client state = %s, %v", c.State(), c.Err())
+	}
+}
+
+func TestDegradedWhileServerUnreachable(t *testing.T) {
+	_, ts := newTestServer(t)
+	states := &stateRecorder{}
+	c := newTestClient(ts, "app-1").OnStateChange(states.record)
+	startTestClient(t, c, func(ctx context.Context, task *Task) (string, error) { return "", nil })
+
+	down := httptest.NewServer(nil)
+	down.Close()
+	c.SetServerAddr(down.URL)
+	states.waitFor(t, STATE_DEGRADED, 1)
+	c.SetServerAddr(ts.URL)
+	states.waitFor(t, STATE_REGISTERED, 2)
+	if c.Err() != nil {
+		t.Fatal("transport errors stopped the client:", c.Err())
+	}
+}
+
+// failingNonceStore is a store failing to record the request nonces
+type failingNonceStore struct {
+	Store
+}
+
+func (f failingNonceStore) MarkNonce(appID, nonce string, expire time.Duration) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func TestRegistrationRetryableFailures(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	params, _ := json.Marshal(RegistrationRequest{AppID: c.AppID, Secret: c.secret})
+
+	// a client clock 10 minutes late
+	dateTime, nonce := TimeFormat(time.Now().Add(-10*time.Minute)), randomHex(16)
+	req, _ := http.NewRequest("POST", ts.URL+apiRoutes["register"], strings.NewReader(string(params)))
+	req.Header.Set("X-FORGE-APPID", c.AppID)
+	req.Header.Set("X-FORGE-TIME", dateTime)
+	req.Header.Set("X-FORGE-NONCE", nonce)
+	req.Header.Set("X-FORGE-SIGN", c.generateSignature("register", dateTime, nonce, string(params)))
+	req.Header.Set("X-FORGE-SIGN-VERSION", SIGN_V2)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body Response
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil || body.Code != 5 {
+		t.Fatalf("registration with a skewed clock = %+v, %v", body, err)
+	}
+
+	store := s.store
+	s.WithStore(failingNonceStore{store})
+	if _, errno, err := c.SendHTTPRequest("register", string(params)); err == nil || errno != 5 {
+		t.Fatalf("registration while the nonce store fails = %v, errno %d", err, errno)
+	}
+	s.WithStore(store)
+
+	// only a rejected credential is reported with code 4
+	if _, errno, err := NewForge("app-1", "other").SetServerAddr(ts.URL).SendHTTPRequest("register", string(params)); err == nil || errno != 4 {
+		t.Fatalf("registration with another secret = %v, errno %d", err, errno)
+	}
+	if err = sendRegistration(c); err != nil {
+		t.Fatal("registration after the retryable failures:", err)
+	}
+}
@@ -0,0 +1,161 @@
+package forge_connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SecretRotation is the payload of a TASK_ROTATE_SECRET task
+type SecretRotation struct {
+	Secret string `json:"secret"`
+}
+
+// isInternalTask reports whether the task type is reserved for the forge protocol
+func isInternalTask(taskType string) bool {
+	return strings.HasPrefix(taskType, INTERNAL_TASK_PREFIX)
+}
+
+// checkTaskType rejects the task types reserved for the forge protocol, only the server creates those tasks
+func checkTaskType(taskType string) error {
+	if isInternalTask(taskType) {
+		return fmt.Errorf("task type prefix %s is reserved", INTERNAL_TASK_PREFIX)
+	}
+	return nil
+}
+
+// WithRotationGrace set how long the previous secret of a client stays valid after RotateSecret
+func (s *Server) WithRotationGrace(grace time.Duration) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if grace > 0 {
+		s.rotationGrace = grace
+	}
+	return s
+}
+
+// RotateSecret issues a new secret to the client, delivered as an urgent TASK_ROTATE_SECRET task
+// encrypted with the current secret. The previous secret is accepted until the rotation grace window ends, the client must fetch
+// the task within this window. Returns the taskID of the rotation task.
+func (s *Server) RotateSecret(appID string) (taskID string, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	clientInfo, err := s.store.GetClientInfo(appID)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	secret, previous, err := s.openSecrets(clientInfo)
+	if err != nil {
+		return
+	}
+	if previous != "" && now.Unix() < clientInfo.PreviousSecretExpire {
+		return "", fmt.Errorf("secret rotation of %s is in progress until %s", appID,
+			TimeFormat(time.Unix(clientInfo.PreviousSecretExpire, 0)))
+	}
+
+	rotation := SecretRotation{Secret: randomHex(32)}
+	payload, _ := json.Marshal(rotation)
+	task := Task{TaskID: uuid.New().String(), TaskType: TASK_ROTATE_SECRET, Payload: string(payload), Priority: PRIORITY_URGENT, Encrypted: true}
+	if err = sealFields(secret, appID, task.TaskID, &task.Payload); err != nil {
+		return
+	}
+	saved := clientInfo
+	clientInfo.PreviousSecretExpire = now.Add(s.rotationGrace).Unix()
+	if err = s.sealSecrets(&clientInfo, rotation.Secret, secret); err != nil {
+		return
+	}
+	if err = s.store.SaveClientInfo(clientInfo, RDX_EXPIRE*time.Second); err != nil {
+		return
+	}
+	if taskID, err = s.enqueueTask(appID, task); err != nil {
+		// the client never receives the new secret, keep the current one
+		if rollbackErr := s.store.SaveClientInfo(saved, RDX_EXPIRE*time.Second); rollbackErr != nil {
+			return "", fmt.Errorf("%v, restore the secret of %s: %v", err, appID, rollbackErr)
+		}
+	}
+	return
+}
+
+// SetSecretFile persist the secret rotated by the server to the file, an existing file
+// replaces the secret given to NewForge so the client keeps its rotated secret across restarts.
+func (c *Client) SetSecretFile(path string) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secretFile = path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			consoleLog("ERROR", "read secret file error: %v", err)
+		}
+		return c
+	}
+	if secret := strings.TrimSpace(string(data)); secret != "" {
+		c.secret = secret
+	}
+	return c
+}
+
+// getSecret returns the current secret of the client
+func (c *Client) getSecret() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secret
+}
+
+// rotateSecret handles a TASK_ROTATE_SECRET task, the new secret is persisted before the client switches to it
+func (c *Client) rotateSecret(ctx context.Context, task *Task) (result string, err error) {
+	var rotation SecretRotation
+	if err = json.Unmarshal([]byte(task.Payload), &rotation); err != nil || rotation.Secret == "" {
+		return "", errors.New("invalid secret rotation payload")
+	}
+	c.mu.Lock()
+	secretFile := c.secretFile
+	c.mu.Unlock()
+	if secretFile != "" {
+		err = writeFileAtomic(secretFile, []byte(rotation.Secret+"\n"), 0600)
+	}
+
+	// switch anyway, the previous secret is only accepted during the grace window
+	c.mu.Lock()
+	c.previousSecret = c.secret
+	c.secret = rotation.Secret
+	c.mu.Unlock()
+	if err != nil {
+		consoleLog("ERROR", "persist rotated secret error: %v", err)
+		return "", fmt.Errorf("secret rotated but not persisted: %v", err)
+	}
+	consoleLog("INFO", "secret rotated, taskID: %s", task.TaskID)
+	return "secret rotated", nil
+}
+
+// writeFileAtomic writes the file through a temporary file in the same directory
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
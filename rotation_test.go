@@ -0,0 +1,144 @@
+package forge_connect
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotateSecret(t *testing.T) {
+	s, ts := newTestServer(t)
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	c := registerClient(t, newTestClient(ts, "app-1").SetSecretFile(secretFile))
+	oldSecret := c.getSecret()
+
+	taskID, err := s.RotateSecret("app-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RotateSecret("app-1"); err == nil {
+		t.Fatal("second rotation during the grace window accepted")
+	}
+	task := fetchTestTask(t, c)
+	if task.TaskID != taskID || task.TaskType != TASK_ROTATE_SECRET {
+		t.Fatalf("fetched task = %+v", task)
+	}
+	c.runTask(task)
+
+	newSecret := c.getSecret()
+	if newSecret == oldSecret {
+		t.Fatal("client secret not rotated")
+	}
+	if data, err := os.ReadFile(secretFile); err != nil || strings.TrimSpace(string(data)) != newSecret {
+		t.Fatalf("secret file = %q, %v", data, err)
+	}
+	if restarted := NewForge("app-1", oldSecret).SetSecretFile(secretFile); restarted.getSecret() != newSecret {
+		t.Fatal("SetSecretFile did not load the rotated secret")
+	}
+	if stored, err := s.store.GetTask("app-1", taskID); err != nil || stored.DoStatus != STATUS_SUCCESS {
+		t.Fatalf("rotation task = %+v, %v", stored, err)
+	}
+
+	// the previous secret is valid until the end of the grace window
+	stale := NewForge("app-1", oldSecret).SetServerAddr(ts.URL)
+	if err = stale.Ping(); err != nil {
+		t.Fatal("previous secret rejected during the grace window:", err)
+	}
+	info, _ := s.store.GetClientInfo("app-1")
+	info.PreviousSecretExpire = time.Now().Add(-time.Second).Unix()
+	if err = s.store.SaveClientInfo(info, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = stale.Ping(); err == nil {
+		t.Fatal("previous secret accepted after the grace window")
+	}
+	if err = c.Ping(); err != nil {
+		t.Fatal("rotated secret rejected:", err)
+	}
+}
+
+// failingPushStore is a store failing to queue tasks
+type failingPushStore struct {
+	Store
+}
+
+func (f failingPushStore) PushTask(appID, taskID string, priority int) error {
+	return errors.New("queue unavailable")
+}
+
+func TestRotateSecretKeepsSecretWhenPushFails(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	store := s.store
+	s.WithStore(failingPushStore{store})
+	if _, err := s.RotateSecret("app-1"); err == nil {
+		t.Fatal("RotateSecret succeeded without queuing the task")
+	}
+
+	// the current secret stays the only one and a later rotation is not blocked by a grace window
+	s.WithStore(store)
+	if err := c.Ping(); err != nil {
+		t.Fatal("current secret rejected after the failed rotation:", err)
+	}
+	if info, err := s.store.GetClientInfo("app-1"); err != nil || info.PreviousSecret != "" || info.PreviousSecretExpire != 0 {
+		t.Fatalf("client info after the failed rotation = %+v, %v", info, err)
+	}
+	if _, err := s.RotateSecret("app-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateSecretTaskNotForUserHandler(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	called := false
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		called = true
+		return "", nil
+	}
+	if _, err := s.RotateSecret("app-1"); err != nil {
+		t.Fatal(err)
+	}
+	c.runTask(fetchTestTask(t, c))
+	if called {
+		t.Fatal("internal task delivered to the user handler")
+	}
+}
+
+func TestReservedTaskTypesRejected(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	for name, submit := range map[string]func() error{
+		"RunSingleTask": func() error {
+			_, _, err := s.RunSingleTask("app-1", TASK_ROTATE_SECRET, `{"secret":"chosen"}`)
+			return err
+		},
+		"RunBroadcastTask": func() error {
+			_, err := s.RunBroadcastTask(nil, TASK_ROTATE_SECRET, `{"secret":"chosen"}`)
+			return err
+		},
+		"ContinuousTask": func() error {
+			_, _, err := s.ContinuousTask("app-1", "forge:other", "")
+			return err
+		},
+		"RunTaskAt": func() error {
+			_, err := s.RunTaskAt("app-1", TASK_ROTATE_SECRET, "", time.Now())
+			return err
+		},
+		"ScheduleTask with selector": func() error {
+			_, err := s.ScheduleTask(ScheduledTask{Selector: "env=prod", TaskType: TASK_ROTATE_SECRET, RunAt: time.Now()})
+			return err
+		},
+	} {
+		if err := submit(); err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Errorf("%s of a reserved task type = %v", name, err)
+		}
+	}
+	if _, errno, err := c.GetTask(); err == nil || errno != 2 {
+		t.Fatalf("GetTask after the rejected submissions = %v, errno %d", err, errno)
+	}
+}
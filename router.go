@@ -0,0 +1,132 @@
+package forge_connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// ErrUnknownTaskType fails the tasks without handler for their task type and without fallback handler
+var ErrUnknownTaskType = errors.New("unknown task type")
+
+// Middleware wraps the task handlers, e.g. to log, time or authorize the tasks
+type Middleware func(next TaskHandler) TaskHandler
+
+// Handle routes the tasks of the type to the handler. The handler passed to Regist or HandleFallback
+// handles the other task types, without it they are reported to the server as failed.
+func (c *Client) Handle(taskType string, handler TaskHandler) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if handler == nil {
+		delete(c.routes, taskType)
+		return c
+	}
+	c.routes[taskType] = handler
+	return c
+}
+
+// HandleFunc routes the tasks of the type to a callback like the one of Regist
+func (c *Client) HandleFunc(taskType string, callback TaskFunc) *Client {
+	return c.Handle(taskType, func(ctx context.Context, task *Task) (string, error) {
+		return callback(task), nil
+	})
+}
+
+// HandleFallback set the handler of the task types without route, same as the handler of RegistHandler
+func (c *Client) HandleFallback(handler TaskHandler) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handler = handler
+	return c
+}
+
+// Use appends middlewares around every routed and fallback handler, the first one is the outermost
+func (c *Client) Use(middlewares ...Middleware) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.middlewares = append(c.middlewares, middlewares...)
+	return c
+}
+
+// route returns the handler of the task type wrapped in the middlewares
+func (c *Client) route(taskType string) TaskHandler {
+	c.mu.Lock()
+	handler, ok := c.routes[taskType]
+	if !ok {
+		handler = c.handler
+	}
+	middlewares := c.middlewares
+	c.mu.Unlock()
+
+	if handler == nil {
+		handler = unknownTaskType
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// unknownTaskType fails a task without handler
+func unknownTaskType(ctx context.Context, task *Task) (string, error) {
+	return "", fmt.Errorf("%w: %s", ErrUnknownTaskType, task.TaskType)
+}
+
+// LoggingMiddleware logs the start and the end of every task
+func LoggingMiddleware() Middleware {
+	return func(next TaskHandler) TaskHandler {
+		return func(ctx context.Context, task *Task) (string, error) {
+			consoleLog("INFO", "task start, taskID: %s, type: %s", task.TaskID, task.TaskType)
+			start := time.Now()
+			result, err := next(ctx, task)
+			if err != nil {
+				consoleLog("ERROR", "task failed, taskID: %s, type: %s, elapsed: %v, error: %v", task.TaskID, task.TaskType, time.Since(start), err)
+			} else {
+				consoleLog("INFO", "task done, taskID: %s, type: %s, elapsed: %v", task.TaskID, task.TaskType, time.Since(start))
+			}
+			return result, err
+		}
+	}
+}
+
+// TimingMiddleware reports the duration and the error of every task to observe, e.g. to feed metrics
+func TimingMiddleware(observe func(task *Task, elapsed time.Duration, err error)) Middleware {
+	return func(next TaskHandler) TaskHandler {
+		return func(ctx context.Context, task *Task) (string, error) {
+			start := time.Now()
+			result, err := next(ctx, task)
+			observe(task, time.Since(start), err)
+			return result, err
+		}
+	}
+}
+
+// RecoveryMiddleware turns a panic of the inner handlers into a task error with the stack,
+// so the outer middlewares see the failure. Panics are always recovered before reaching the client.
+func RecoveryMiddleware() Middleware {
+	return func(next TaskHandler) TaskHandler {
+		return func(ctx context.Context, task *Task) (result string, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					consoleLog("ERROR", "task handler panic, taskID: %s, %v", task.TaskID, r)
+					err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+				}
+			}()
+			return next(ctx, task)
+		}
+	}
+}
+
+// AuthMiddleware runs check before the handler, an error of check fails the task without calling the handler
+func AuthMiddleware(check func(ctx context.Context, task *Task) error) Middleware {
+	return func(next TaskHandler) TaskHandler {
+		return func(ctx context.Context, task *Task) (string, error) {
+			if err := check(ctx, task); err != nil {
+				return "", err
+			}
+			return next(ctx, task)
+		}
+	}
+}
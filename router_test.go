@@ -0,0 +1,105 @@
+package forge_connect
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	c := NewForge("app-1", "secret").
+		Handle("echo", func(ctx context.Context, task *Task) (string, error) { return "echo:" + task.Payload, nil }).
+		HandleFunc("upper", func(task *Task) string { return strings.ToUpper(task.Payload) })
+	call := func(taskType string) (string, error) {
+		return c.callHandler(context.Background(), &Task{TaskType: taskType, Payload: "hi"})
+	}
+
+	for taskType, want := range map[string]string{"echo": "echo:hi", "upper": "HI"} {
+		if result, err := call(taskType); err != nil || result != want {
+			t.Errorf("%s task = %q, %v, want %q", taskType, result, err, want)
+		}
+	}
+	if _, err := call("other"); !errors.Is(err, ErrUnknownTaskType) {
+		t.Fatalf("task without route error = %v, want ErrUnknownTaskType", err)
+	}
+
+	c.HandleFallback(func(ctx context.Context, task *Task) (string, error) { return "fallback", nil })
+	c.Handle("echo", nil)
+	for _, taskType := range []string{"other", "echo"} {
+		if result, err := call(taskType); err != nil || result != "fallback" {
+			t.Errorf("%s task = %q, %v, want the fallback", taskType, result, err)
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next TaskHandler) TaskHandler {
+			return func(ctx context.Context, task *Task) (string, error) {
+				calls = append(calls, name+" before")
+				result, err := next(ctx, task)
+				calls = append(calls, name+" after")
+				return result, err
+			}
+		}
+	}
+	var observed error
+	c := NewForge("app-1", "secret").
+		Use(trace("outer"), trace("inner")).
+		Use(TimingMiddleware(func(task *Task, elapsed time.Duration, err error) { observed = err })).
+		Use(AuthMiddleware(func(ctx context.Context, task *Task) error {
+			if task.Payload == "denied" {
+				return errors.New("not authorized")
+			}
+			return nil
+		})).
+		Use(RecoveryMiddleware()).
+		Handle("job", func(ctx context.Context, task *Task) (string, error) {
+			calls = append(calls, "handler")
+			if task.Payload == "panic" {
+				panic("handler bug")
+			}
+			return "ok", nil
+		})
+
+	if result, err := c.callHandler(context.Background(), &Task{TaskType: "job"}); err != nil || result != "ok" {
+		t.Fatalf("job = %q, %v", result, err)
+	}
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+
+	calls = nil
+	if _, err := c.callHandler(context.Background(), &Task{TaskType: "job", Payload: "denied"}); err == nil || observed != err {
+		t.Fatalf("denied job error = %v, observed %v", err, observed)
+	}
+	for _, call := range calls {
+		if call == "handler" {
+			t.Fatal("denied job reached the handler")
+		}
+	}
+
+	// the recovered panic is seen by the outer middlewares
+	if _, err := c.callHandler(context.Background(), &Task{TaskType: "job", Payload: "panic"}); err == nil ||
+		!strings.HasPrefix(err.Error(), "panic: handler bug") || observed != err {
+		t.Fatalf("panicking job error = %v, observed %v", err, observed)
+	}
+}
+
+func TestUnroutedTaskReportedFailed(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1").HandleFunc("echo", func(task *Task) string { return task.Payload })
+	taskID, err := s.addTask("app-1", "unknown", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTask(fetchTestTask(t, c))
+	stored, err := s.store.GetTask("app-1", taskID)
+	if err != nil || stored.DoStatus != STATUS_FAILED || !strings.Contains(stored.Error, ErrUnknownTaskType.Error()) {
+		t.Fatalf("stored task = %+v, %v", stored, err)
+	}
+}
@@ -0,0 +1,241 @@
+package forge_connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ScheduledTask is a task submitted at a future time, once (RunAt) or repeatedly (Cron)
+type ScheduledTask struct {
+	ScheduleID string    `json:"schedule_id"`
+	AppID      string    `json:"app_id"`   // Target client, or
+	Selector   string    `json:"selector"` // Label selector resolved to the live clients when the task is due
+	TaskType   string    `json:"task_type"`
+	Payload    string    `json:"payload"`
+	Priority   int       `json:"priority"`
+	Cron       string    `json:"cron"`   // Cron expression, empty for a one-shot task
+	RunAt      time.Time `json:"run_at"` // Next due time
+	CreateAt   time.Time `json:"create_at"`
+}
+
+// scheduleClaimLease is how long a claimed due entry waits for its promotion before it is due again
+const scheduleClaimLease = time.Minute
+
+// RunTaskAt schedule a one-shot task for the client at the given time
+func (s *Server) RunTaskAt(appID, taskType, payload string, at time.Time) (scheduleID string, err error) {
+	return s.ScheduleTask(ScheduledTask{AppID: appID, TaskType: taskType, Payload: payload, RunAt: at})
+}
+
+// RunTaskCron schedule a recurring task for the client with a cron expression, see ParseCron
+func (s *Server) RunTaskCron(appID, spec, taskType, payload string) (scheduleID string, err error) {
+	return s.ScheduleTask(ScheduledTask{AppID: appID, TaskType: taskType, Payload: payload, Cron: spec})
+}
+
+// ScheduleTask stores a scheduled task targeting either AppID or Selector.
+// A cron task without RunAt is first due at the next cron activation.
+func (s *Server) ScheduleTask(sch ScheduledTask) (scheduleID string, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	if (sch.AppID == "") == (sch.Selector == "") {
+		return "", errors.New("scheduled task requires either app_id or selector")
+	}
+	if err = checkTaskType(sch.TaskType); err != nil {
+		return
+	}
+	if sch.Selector != "" {
+		if _, err = ParseSelector(sch.Selector); err != nil {
+			return
+		}
+	}
+	if sch.AppID != "" {
+		if err = s.authorizeTask(sch.AppID, sch.TaskType, sch.Payload); err != nil {
+			return
+		}
+	}
+	now := time.Now()
+	if sch.Cron != "" {
+		cron, err := ParseCron(sch.Cron)
+		if err != nil {
+			return "", err
+		}
+		if sch.RunAt.IsZero() {
+			sch.RunAt = cron.Next(now)
+		}
+	}
+	if sch.RunAt.IsZero() {
+		return "", errors.New("scheduled task requires run_at or cron")
+	}
+
+	sch.ScheduleID = uuid.New().String()
+	sch.CreateAt = now
+	if err = s.store.SaveSchedule(sch); err != nil {
+		return
+	}
+	if err = s.store.AddDue(sch.ScheduleID, sch.RunAt); err != nil {
+		return
+	}
+	return sch.ScheduleID, nil
+}
+
+// Unschedule removes a scheduled task
+func (s *Server) Unschedule(scheduleID string) (err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	return s.store.DeleteSchedule(scheduleID)
+}
+
+// ListSchedules returns the scheduled tasks waiting for their due time
+func (s *Server) ListSchedules() (schedules []ScheduledTask, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	scheduleIDs, err := s.store.ListDue()
+	if err != nil {
+		return
+	}
+	for _, scheduleID := range scheduleIDs {
+		sch, err := s.store.GetSchedule(scheduleID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, sch)
+	}
+	return
+}
+
+// StartScheduler runs PromoteDueTasks every interval until ctx is done.
+// The store must outlive a single http request, e.g. WithStore(NewRedisPoolStore(pool)).
+func (s *Server) StartScheduler(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				consoleLog("INFO", "task scheduler stopped.")
+				return
+			case <-ticker.C:
+				promoted, err := s.PromoteDueTasks()
+				if err != nil {
+					consoleLog("ERROR", "task scheduler error: %v", err)
+				}
+				if s.IsDebug && promoted > 0 {
+					consoleLog("DEBUG", "task scheduler promoted: %d", promoted)
+				}
+			}
+		}
+	}()
+}
+
+// PromoteDueTasks moves the due scheduled tasks into the task queue of their clients.
+// Every due entry is claimed by one replica only under a lease. When the replica or the store fails before the next
+// due time is saved, the entry is claimed again once the lease expires. Each activation is recorded per client before
+// its task is queued, so a retried activation only queues the tasks the failed attempt did not.
+func (s *Server) PromoteDueTasks() (promoted int, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for {
+		scheduleIDs, err := s.store.ClaimDue(now, scheduleClaimLease, 100)
+		if err != nil {
+			return promoted, err
+		}
+		if len(scheduleIDs) == 0 {
+			return promoted, nil
+		}
+		for _, scheduleID := range scheduleIDs {
+			count, err := s.promoteSchedule(scheduleID, now)
+			if err != nil {
+				consoleLog("ERROR", "promote scheduled task %s error: %v", scheduleID, err)
+			}
+			promoted += count
+		}
+	}
+}
+
+// promoteSchedule enqueue a claimed scheduled task and set its next due time. On error the due entry is
+// left to the lease, the activation is promoted again once it expires.
+func (s *Server) promoteSchedule(scheduleID string, now time.Time) (promoted int, err error) {
+	sch, err := s.store.GetSchedule(scheduleID)
+	if errors.Is(err, ErrNotFound) {
+		// drop the due entry of a removed schedule
+		return 0, s.store.DeleteSchedule(scheduleID)
+	}
+	if err != nil {
+		return
+	}
+
+	appIDs := []string{sch.AppID}
+	if sch.Selector != "" {
+		if appIDs, err = s.SelectClients(sch.Selector); err != nil {
+			return
+		}
+	}
+	for _, appID := range appIDs {
+		count, pushErr := s.promoteRun(sch, appID)
+		if pushErr != nil {
+			return promoted, fmt.Errorf("add task for %s: %v", appID, pushErr)
+		}
+		promoted += count
+	}
+
+	if sch.Cron == "" {
+		return promoted, s.store.DeleteSchedule(scheduleID)
+	}
+	cron, cronErr := ParseCron(sch.Cron)
+	if cronErr != nil {
+		return promoted, cronErr
+	}
+	sch.RunAt = cron.Next(now)
+	if sch.RunAt.IsZero() {
+		return promoted, s.store.DeleteSchedule(scheduleID)
+	}
+	if saveErr := s.store.SaveSchedule(sch); saveErr != nil {
+		return promoted, saveErr
+	}
+	if dueErr := s.store.AddDue(scheduleID, sch.RunAt); dueErr != nil {
+		return promoted, dueErr
+	}
+	return
+}
+
+// promoteRun queues the task of the current activation of a scheduled task for a client, unless an
+// earlier attempt already queued it. A task denied by the task policies is skipped.
+func (s *Server) promoteRun(sch ScheduledTask, appID string) (promoted int, err error) {
+	fresh, err := s.store.MarkScheduleRun(sch.ScheduleID, sch.RunAt, appID, RDX_EXPIRE*time.Second)
+	if err != nil || !fresh {
+		return
+	}
+	taskID, err := s.pushTask(appID, Task{TaskType: sch.TaskType, Payload: sch.Payload, Priority: sch.Priority})
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		// the other clients of the selector still receive the task
+		consoleLog("ERROR", "promote scheduled task %s: %v", sch.ScheduleID, policyErr)
+		return 0, nil
+	}
+	if err != nil {
+		if unmarkErr := s.store.UnmarkScheduleRun(sch.ScheduleID, sch.RunAt, appID); unmarkErr != nil {
+			consoleLog("ERROR", "unmark scheduled task run %s error: %v", sch.ScheduleID, unmarkErr)
+		}
+		return
+	}
+	if s.IsDebug {
+		log.Println("[DEBUG] promote scheduled task:", sch.ScheduleID, appID, taskID)
+	}
+	return 1, nil
+}
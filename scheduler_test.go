@@ -0,0 +1,135 @@
+package forge_connect
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPromoteDueTasks(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	now := time.Now()
+
+	if _, err := s.RunTaskAt("app-1", "report", "due", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RunTaskAt("app-1", "report", "later", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	cronID, err := s.ScheduleTask(ScheduledTask{AppID: "app-1", TaskType: "rotate", Cron: "0 * * * *", RunAt: now.Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if promoted, err := s.PromoteDueTasks(); err != nil || promoted != 2 {
+		t.Fatalf("PromoteDueTasks = %d, %v, want 2", promoted, err)
+	}
+	if promoted, err := s.PromoteDueTasks(); err != nil || promoted != 0 {
+		t.Fatalf("second PromoteDueTasks = %d, %v, want 0", promoted, err)
+	}
+	payloads := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		task := fetchTestTask(t, c)
+		payloads[task.TaskType+":"+task.Payload] = true
+	}
+	if !payloads["report:due"] || !payloads["rotate:"] {
+		t.Fatalf("promoted tasks = %v", payloads)
+	}
+
+	schedules, err := s.ListSchedules()
+	if err != nil || len(schedules) != 2 {
+		t.Fatalf("ListSchedules = %+v, %v, want the future and the cron schedule", schedules, err)
+	}
+	for _, sch := range schedules {
+		if sch.ScheduleID == cronID && !sch.RunAt.After(now) {
+			t.Errorf("cron schedule not advanced, run at %v", sch.RunAt)
+		}
+	}
+	if err = s.Unschedule(cronID); err != nil {
+		t.Fatal(err)
+	}
+	if schedules, _ = s.ListSchedules(); len(schedules) != 1 {
+		t.Fatalf("ListSchedules after Unschedule = %+v", schedules)
+	}
+}
+
+func TestPromoteSelectorSchedule(t *testing.T) {
+	s, ts := newTestServer(t)
+	registerClient(t, newTestClient(ts, "web-1").SetLabels(map[string]string{"role": "web"}))
+	registerClient(t, newTestClient(ts, "web-2").SetLabels(map[string]string{"role": "web"}))
+	registerClient(t, newTestClient(ts, "db-1").SetLabels(map[string]string{"role": "db"}))
+
+	_, err := s.ScheduleTask(ScheduledTask{Selector: "role=web", TaskType: "deploy", RunAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted, err := s.PromoteDueTasks(); err != nil || promoted != 2 {
+		t.Fatalf("PromoteDueTasks = %d, %v, want 2", promoted, err)
+	}
+}
+
+func TestScheduleTaskValidation(t *testing.T) {
+	s, _ := newTestServer(t)
+	at := time.Now().Add(time.Hour)
+	for _, sch := range []ScheduledTask{
+		{TaskType: "report", RunAt: at},
+		{AppID: "app-1", Selector: "role=web", TaskType: "report", RunAt: at},
+		{Selector: "role in (", TaskType: "report", RunAt: at},
+		{AppID: "app-1", TaskType: "report"},
+		{AppID: "app-1", TaskType: "report", Cron: "61 * * * *"},
+	} {
+		if _, err := s.ScheduleTask(sch); err == nil {
+			t.Errorf("ScheduleTask(%+v) accepted an invalid schedule", sch)
+		}
+	}
+}
+
+// failingAppStore is a store failing to queue the tasks of one client
+type failingAppStore struct {
+	Store
+	appID string
+}
+
+func (f failingAppStore) PushTask(appID, taskID string, priority int) error {
+	if appID == f.appID {
+		return errors.New("queue unavailable")
+	}
+	return f.Store.PushTask(appID, taskID, priority)
+}
+
+func TestPromoteRetriesFailedActivation(t *testing.T) {
+	s, ts := newTestServer(t)
+	web1 := registerClient(t, newTestClient(ts, "web-1").SetLabels(map[string]string{"role": "web"}))
+	web2 := registerClient(t, newTestClient(ts, "web-2").SetLabels(map[string]string{"role": "web"}))
+	scheduleID, err := s.ScheduleTask(ScheduledTask{Selector: "role=web", TaskType: "deploy", RunAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := s.store
+	s.WithStore(failingAppStore{Store: store, appID: "web-2"})
+	if promoted, err := s.PromoteDueTasks(); err != nil || promoted != 1 {
+		t.Fatalf("PromoteDueTasks = %d, %v, want the task of web-1 only", promoted, err)
+	}
+	s.WithStore(store)
+	if _, err = s.store.GetSchedule(scheduleID); err != nil {
+		t.Fatal("schedule removed after the failed promotion:", err)
+	}
+
+	// the lease of the claimed entry expired, the activation is promoted again for web-2 only
+	if promoted, err := s.promoteSchedule(scheduleID, time.Now()); err != nil || promoted != 1 {
+		t.Fatalf("promoteSchedule retry = %d, %v, want 1", promoted, err)
+	}
+	for _, c := range []*Client{web1, web2} {
+		if task := fetchTestTask(t, c); task.TaskType != "deploy" {
+			t.Fatalf("%s task = %+v", c.AppID, task)
+		}
+		if _, errno, err := c.GetTask(); err == nil || errno != 2 {
+			t.Fatalf("%s received the activation twice: %v, errno %d", c.AppID, err, errno)
+		}
+	}
+	if _, err = s.store.GetSchedule(scheduleID); err == nil {
+		t.Fatal("schedule kept after its promotion")
+	}
+}
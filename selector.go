@@ -0,0 +1,184 @@
+package forge_connect
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// selector operators
+const (
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+	selectorIn        = "in"
+	selectorNotIn     = "notin"
+	selectorExists    = "exists"
+	selectorNotExists = "!"
+)
+
+var labelKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.\-/]{0,62})$`)
+
+// Selector matches client labels, it is built by ParseSelector
+type Selector struct {
+	requirements []selectorRequirement
+}
+
+type selectorRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+// ParseSelector parses a comma separated list of label requirements, an empty expression matches every client.
+// Supported requirements:
+//
+//	region=eu, region==eu   equality
+//	region!=eu              inequality, also matches clients without the label
+//	region in (eu,us)       set membership
+//	region notin (eu,us)    set exclusion, also matches clients without the label
+//	region                  label exists
+//	!region                 label does not exist
+func ParseSelector(expr string) (sel Selector, err error) {
+	for _, part := range splitSelector(expr) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		req, err := parseRequirement(part)
+		if err != nil {
+			return sel, err
+		}
+		sel.requirements = append(sel.requirements, req)
+	}
+	return
+}
+
+// Matches reports whether the labels satisfy every requirement of the selector
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, req := range sel.requirements {
+		value, ok := labels[req.key]
+		switch req.operator {
+		case selectorEquals:
+			if !ok || value != req.values[0] {
+				return false
+			}
+		case selectorNotEquals:
+			if ok && value == req.values[0] {
+				return false
+			}
+		case selectorIn:
+			if !ok || !containsString(req.values, value) {
+				return false
+			}
+		case selectorNotIn:
+			if ok && containsString(req.values, value) {
+				return false
+			}
+		case selectorExists:
+			if !ok {
+				return false
+			}
+		case selectorNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String returns the selector in its canonical text form
+func (sel Selector) String() string {
+	parts := make([]string, 0, len(sel.requirements))
+	for _, req := range sel.requirements {
+		switch req.operator {
+		case selectorEquals, selectorNotEquals:
+			parts = append(parts, req.key+req.operator+req.values[0])
+		case selectorIn, selectorNotIn:
+			parts = append(parts, req.key+" "+req.operator+" ("+strings.Join(req.values, ",")+")")
+		case selectorExists:
+			parts = append(parts, req.key)
+		case selectorNotExists:
+			parts = append(parts, "!"+req.key)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitSelector split the expression on commas outside of parentheses
+func splitSelector(expr string) (parts []string) {
+	depth, start := 0, 0
+	for i, ch := range expr {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+func parseRequirement(part string) (req selectorRequirement, err error) {
+	switch {
+	case strings.HasPrefix(part, "!") && !strings.Contains(part, "="):
+		req = selectorRequirement{key: strings.TrimSpace(part[1:]), operator: selectorNotExists}
+	case strings.Contains(part, "!="):
+		kv := strings.SplitN(part, "!=", 2)
+		req = selectorRequirement{key: strings.TrimSpace(kv[0]), operator: selectorNotEquals, values: []string{strings.TrimSpace(kv[1])}}
+	case strings.Contains(part, "="):
+		kv := strings.SplitN(part, "=", 2)
+		value := strings.TrimPrefix(kv[1], "=")
+		req = selectorRequirement{key: strings.TrimSpace(kv[0]), operator: selectorEquals, values: []string{strings.TrimSpace(value)}}
+	case strings.Contains(part, "("):
+		fields := strings.Fields(part[:strings.Index(part, "(")])
+		if len(fields) != 2 || (fields[1] != selectorIn && fields[1] != selectorNotIn) || !strings.HasSuffix(part, ")") {
+			return req, fmt.Errorf("invalid selector requirement %q", part)
+		}
+		req = selectorRequirement{key: fields[0], operator: fields[1]}
+		for _, value := range strings.Split(part[strings.Index(part, "(")+1:len(part)-1], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				req.values = append(req.values, value)
+			}
+		}
+		if len(req.values) == 0 {
+			return req, fmt.Errorf("empty value set in selector requirement %q", part)
+		}
+		sort.Strings(req.values)
+	default:
+		req = selectorRequirement{key: part, operator: selectorExists}
+	}
+
+	if !labelKeyRegexp.MatchString(req.key) {
+		return req, fmt.Errorf("invalid label key in selector requirement %q", part)
+	}
+	return
+}
+
+// validateLabels checks the label keys declared by a client
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyRegexp.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if strings.ContainsAny(value, ",()=! ") {
+			return fmt.Errorf("invalid value of label %q", key)
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
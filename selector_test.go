@@ -0,0 +1,97 @@
+package forge_connect
+
+import "testing"
+
+func TestParseSelectorMatches(t *testing.T) {
+	labels := map[string]string{"region": "eu", "role": "web", "tier": "1"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"region=eu", true},
+		{"region==eu", true},
+		{"region=us", false},
+		{"region!=us", true},
+		{"zone!=a", true},
+		{"region in (eu,us)", true},
+		{"region in (us, asia)", false},
+		{"zone in (a)", false},
+		{"region notin (us)", true},
+		{"zone notin (a)", true},
+		{"role notin (web,db)", false},
+		{"role", true},
+		{"zone", false},
+		{"!zone", true},
+		{"!role", false},
+		{"region=eu, role in (web,db), !zone", true},
+		{"region=eu,role=db", false},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.expr)
+		if err != nil {
+			t.Errorf("ParseSelector(%q) error: %v", tt.expr, err)
+			continue
+		}
+		if got := sel.Matches(labels); got != tt.want {
+			t.Errorf("ParseSelector(%q).Matches = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseSelectorString(t *testing.T) {
+	sel, err := ParseSelector("region == eu, role in (web, db),!zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sel.String(), "region=eu,role in (db,web),!zone"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"region in ()",
+		"region in (eu",
+		"region within (eu)",
+		"-region=eu",
+		"=eu",
+	} {
+		if _, err := ParseSelector(expr); err == nil {
+			t.Errorf("ParseSelector(%q) accepted an invalid expression", expr)
+		}
+	}
+}
+
+func TestListClientsBySelector(t *testing.T) {
+	s, ts := newTestServer(t)
+	registerClient(t, newTestClient(ts, "web-1").SetLabels(map[string]string{"role": "web", "region": "eu"}))
+	registerClient(t, newTestClient(ts, "web-2").SetLabels(map[string]string{"role": "web", "region": "us"}))
+	registerClient(t, newTestClient(ts, "db-1").SetLabels(map[string]string{"role": "db", "region": "eu"}))
+
+	clients, err := s.ListClients("role=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 {
+		t.Fatalf("ListClients(role=web) = %+v", clients)
+	}
+	appIDs, err := s.SelectClients("region=eu,role notin (web)")
+	if err != nil || len(appIDs) != 1 || appIDs[0] != "db-1" {
+		t.Fatalf("SelectClients = %v, %v", appIDs, err)
+	}
+	if _, err = s.RunSelectorTask("role=cache", "restart", ""); err == nil {
+		t.Fatal("RunSelectorTask without matching client succeeded")
+	}
+	if _, err = s.ListClients("role in ("); err == nil {
+		t.Fatal("ListClients accepted an invalid selector")
+	}
+}
+
+func TestRegisterRejectsInvalidLabels(t *testing.T) {
+	_, ts := newTestServer(t)
+	c := newTestClient(ts, "app-1").SetLabels(map[string]string{"role": "web,db"})
+	if err := sendRegistration(c); err == nil {
+		t.Fatal("registration with an invalid label value accepted")
+	}
+}
@@ -2,9 +2,8 @@ package forge_connect
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -22,16 +21,19 @@ import (
 var payloadChannel = make(chan string, 500) // Buffered channel with a capacity of 100
 
 type ClientInfo struct {
-	AppID              string `json:"app_id"`
-	Secret             string `json:"secret"`
-	RegisterTime       int64  `json:"register_time"`
-	LastPingTime       int64  `json:"last_ping_time"`
-	DoStatus           string `json:"do_status"`
-	ProcessedTaskCount int    `json:"processed_task_count"`
+	AppID              string            `json:"app_id"`
+	RegisterTime       int64             `json:"register_time"`
+	LastPingTime       int64             `json:"last_ping_time"`
+	DoStatus           string            `json:"do_status"`
+	ProcessedTaskCount int               `json:"processed_task_count"`
+	Labels             map[string]string `json:"labels"`
+	EnrollLabels       map[string]string `json:"enroll_labels,omitempty"` // Labels forced by the enrollment token
+
+	PreviousSecretExpire int64 `json:"previous_secret_expire,omitempty"` // End of the grace window of the secret replaced by RotateSecret
 }
 
 type Server struct {
-	redisConn        rdx.Conn
+	store            Store
 	IsDebug          bool
 	ServerName       string
 	SessionId        string
@@ -40,9 +42,26 @@ type Server struct {
 	statusFunc       func(i Task)
 	mutex            sync.Mutex
 	singleTimeout    time.Duration
-	longLoopDuration time.Duration
-	taskChan         map[string]chan Task
-	taskWaitTick     time.Duration
+	streamTimeout    time.Duration
+	broadcastTimeout time.Duration
+	lockTimeout      time.Duration
+	maxAttempts      int
+
+	legacyRegistration bool
+	signV1Until        time.Time
+	rotationGrace      time.Duration
+	encryptPayload     bool
+	masterKeys         map[string][]byte
+	masterKeyID        string
+	authMode           string
+	ca                 *CA
+	taskSigningKey     ed25519.PrivateKey
+	enforcePolicies    bool
+	rateLimits         map[string]apiRateLimit
+	lockout            *lockoutPolicy
+	clientIPHeader     string
+	longLoopDuration   time.Duration
+	taskWaitTick       time.Duration
 }
 
 func NewServer(serverName string) *Server {
@@ -52,8 +71,13 @@ func NewServer(serverName string) *Server {
 		SessionId:        uuid.New().String(),
 		statusFunc:       listenTaskStatus,
 		singleTimeout:    30 * time.Second,
+		streamTimeout:    10 * time.Minute,
+		broadcastTimeout: 60 * time.Second,
+		lockTimeout:      120 * time.Second,
+		maxAttempts:      3,
+		rotationGrace:    time.Hour,
+		authMode:         AUTH_HMAC,
 		longLoopDuration: 10 * time.Second,
-		taskChan:         make(map[string]chan Task),
 		taskWaitTick:     1 * time.Second,
 	}
 }
@@ -74,7 +98,15 @@ func (s *Server) SetTaskWaitTick(duration time.Duration) *Server {
 func (s *Server) WithRdx(conn rdx.Conn) *Server {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.redisConn = conn
+	s.store = NewRedisStore(conn)
+	return s
+}
+
+// WithStore use the storage backend, e.g. NewMemoryStore() or NewRedisPoolStore(pool)
+func (s *Server) WithStore(store Store) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store = store
 	return s
 }
 
@@ -86,6 +118,51 @@ func (s *Server) WithSingleTimeout(timeout time.Duration) *Server {
 	return s
 }
 
+// WithBroadcastTimeout set the overall deadline of a broadcast task
+func (s *Server) WithBroadcastTimeout(timeout time.Duration) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.broadcastTimeout = timeout
+	return s
+}
+
+// WithSignatureMigration accept v1 signatures until the given time, v2 signatures are always accepted.
+// Without migration deadline v1 signatures are accepted indefinitely.
+func (s *Server) WithSignatureMigration(v1Until time.Time) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.signV1Until = v1Until
+	return s
+}
+
+// WithLockTimeout set how long a delivered task stays locked to the client, the reaper redelivers a task
+// when its lock expired without a terminal status. Every ping of the client extends the locks of the tasks
+// it still handles, so the timeout must only exceed a few ping intervals.
+func (s *Server) WithLockTimeout(timeout time.Duration) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lockTimeout = timeout
+	return s
+}
+
+// WithMaxAttempts set how many times a task is delivered before the reaper moves it to the dead-letter queue
+func (s *Server) WithMaxAttempts(attempts int) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if attempts > 0 {
+		s.maxAttempts = attempts
+	}
+	return s
+}
+
+// WithStreamTimeout set continuous task timeout duration
+func (s *Server) WithStreamTimeout(timeout time.Duration) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streamTimeout = timeout
+	return s
+}
+
 // WithRdx add the fresh redis connect
 func (s *Server) WithStatusFunc(statusFunc func(i Task)) *Server {
 	s.mutex.Lock()
@@ -97,89 +174,259 @@ func (s *Server) WithStatusFunc(statusFunc func(i Task)) *Server {
 }
 
 // ContinuousTask After Execution Completes, Asynchronously Receive Messages (e.g., Query Logs, Execute Commands)
-func (s *Server)ContinuousTask(appID , taskType, payload string)(err error){
+// The returned channel yields every message the client pushes for the task and is closed after
+// the terminal message (Done is true) or when the stream timeout is reached.
+// The store connection must stay open until the channel is closed.
+func (s *Server) ContinuousTask(appID, taskType, payload string) (taskID string, messages <-chan TaskMessage, err error) {
+	err = s.AppLiveCheck(appID)
+	if err != nil {
+		return
+	}
+	taskID, err = s.pushTask(appID, Task{TaskType: taskType, Payload: payload, Continuous: true})
+	if err != nil {
+		return
+	}
+	if s.IsDebug {
+		log.Println("[DEBUG] add continuous task:", taskID)
+	}
 
+	msgChan := make(chan TaskMessage, 100)
+	go s.listenTaskMessages(appID, taskID, msgChan)
+	return taskID, msgChan, nil
+}
+
+// listenTaskMessages moves the pushed messages of a continuous task into msgChan until the stream ends.
+// A caller that stops reading only blocks it until the stream timeout.
+func (s *Server) listenTaskMessages(appID, taskID string, msgChan chan<- TaskMessage) {
+	defer close(msgChan)
+
+	ticker := time.NewTicker(s.taskWaitTick)
+	defer ticker.Stop()
+	timeout := time.After(s.streamTimeout)
+	for {
+		select {
+		case <-timeout:
+			if s.IsDebug {
+				consoleLog("DEBUG", "continuous task listen timeout, taskID: %v", taskID)
+			}
+			// the caller may no longer read, drop the message when the buffer is full
+			select {
+			case msgChan <- TaskMessage{
+				TaskID:   taskID,
+				MsgType:  EXPIRE_TYPE,
+				Content:  fmt.Sprintf("timeout waiting for task %s", taskID),
+				Done:     true,
+				CreateAt: time.Now(),
+			}:
+			default:
+			}
+			return
+		case <-ticker.C:
+			for {
+				msg, err := s.store.PopMessage(appID, taskID)
+				if errors.Is(err, ErrNotFound) {
+					break
+				}
+				if err != nil {
+					// retry on the next tick
+					consoleLog("ERROR", "pop task message error: %v, taskID: %v", err, taskID)
+					break
+				}
+				if err = s.openMessage(appID, &msg); err != nil {
+					msg.MsgType, msg.Content = ERR_TYPE, err.Error()
+				}
+				select {
+				case msgChan <- msg:
+				case <-timeout:
+					consoleLog("ERROR", "continuous task messages not read before the stream timeout, taskID: %v", taskID)
+					return
+				}
+				if msg.Done {
+					return
+				}
+			}
+		}
+	}
 }
 
 // RunSingleTask quickly send a task to the specified appid client and wait for the return
+// The result is published through the store, so the client may report it to any server replica.
 func (s *Server) RunSingleTask(appID, taskType, payload string) (taskID, respBody string, err error) {
+	return s.RunSingleTaskWithPriority(appID, taskType, payload, PRIORITY_NORMAL)
+}
+
+// RunSingleTaskWithPriority same as RunSingleTask, the task is delivered before any queued task of a lower priority
+func (s *Server) RunSingleTaskWithPriority(appID, taskType, payload string, priority int) (taskID, respBody string, err error) {
 	err = s.AppLiveCheck(appID)
 	if err != nil {
 		return
 	}
-	taskID, err = s.addTask(appID, taskType, payload)
+	taskID, err = s.pushTask(appID, Task{TaskType: taskType, Payload: payload, Priority: priority})
+	if err != nil {
+		return
+	}
 	sttm := time.Now()
 	if s.IsDebug {
 		log.Println("[DEBUG] add task:", taskID)
 	}
 
-	// 创建独立的结果通道
-	resultChan := make(chan Task, 1)
-	defer func() {
-		delete(s.taskChan, taskID) // 删除任务通道映射
-	}()
-
-	s.mutex.Lock()
-	s.taskChan[taskID] = resultChan // 将通道映射到任务ID
-	s.mutex.Unlock()
+	ticker := time.NewTicker(s.taskWaitTick)
+	defer ticker.Stop()
+	timeout := time.After(s.singleTimeout)
 
 	// 等待任务结果或超时
-	select {
-	case task := <-resultChan:
-		return taskID, task.Result, nil
-	case <-time.After(s.singleTimeout):
-		during := time.Since(sttm)
-		if s.IsDebug {
-			consoleLog("DEBUG", "task listen timeout during: %v， taskID: %v", during, taskID)
+	for {
+		select {
+		case <-ticker.C:
+			task, err := s.store.PopResult(appID, taskID)
+			if err != nil {
+				continue
+			}
+			if err = s.openTask(appID, &task); err != nil {
+				return taskID, "", err
+			}
+			if task.DoStatus == STATUS_CANCELLED || task.DoStatus == STATUS_FAILED || task.DoStatus == STATUS_DEAD {
+				return taskID, task.Result, &TaskError{TaskID: taskID, Status: task.DoStatus, Message: task.Error}
+			}
+			return taskID, task.Result, nil
+		case <-timeout:
+			during := time.Since(sttm)
+			if s.IsDebug {
+				consoleLog("DEBUG", "task listen timeout during: %v， taskID: %v", during, taskID)
+			}
+			return taskID, "", fmt.Errorf("timeout waiting for task %s", taskID)
 		}
-		return taskID, "", fmt.Errorf("timeout waiting for task %s", taskID)
 	}
 }
 
+// CancelTask cancel a task which is not finished yet.
+// A pending task is never delivered, a delivered task receives the cancel signal on the next client ping,
+// its handler context is cancelled and the client reports the cancelled status back.
+func (s *Server) CancelTask(appID, taskID string) (err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	task, err := s.store.GetTask(appID, taskID)
+	if err != nil {
+		return
+	}
+	if task.DoStatus != "" && task.DoStatus != STATUS_DOING {
+		return fmt.Errorf("task %s is already finished with status %s", taskID, task.DoStatus)
+	}
+
+	task.DoStatus = STATUS_CANCELLED
+	if err = s.store.SaveTask(appID, task, RDX_EXPIRE*time.Second); err != nil {
+		return
+	}
+	if err = s.store.AddCancel(appID, taskID); err != nil {
+		return
+	}
+	// wake the waiter at once, the client report arrives later
+	return s.store.PushResult(appID, task, RESULT_EXPIRE*time.Second)
+}
+
 // AppLiveCheck check app connect status
 func (s *Server) AppLiveCheck(appID string) (err error) {
 	err = s.verifyOpts()
 	if err != nil {
 		return
 	}
-	cacheKey := GetClientInfoKey(appID)
-	clientJson, _ := rdx.String(s.redisConn.Do("GET", cacheKey))
-	clientInfo := ClientInfo{}
-	json.Unmarshal([]byte(clientJson), &clientInfo)
+	clientInfo, _ := s.store.GetClientInfo(appID)
 	now := time.Now().Unix()
 	if clientInfo.AppID == "" {
 		return errors.New("not found app info")
 	}
 	sincTm := now - clientInfo.LastPingTime
-	if sincTm > 90 {
-		clientInfo.DoStatus = STATUS_TIMEOUT
-		infoJSON, _ := json.Marshal(clientInfo)
-		_, err = s.redisConn.Do("SETEX", cacheKey, RDX_EXPIRE, infoJSON)
-
+	if sincTm > LIVE_EXPIRE {
 		return errors.New("the client is disconnected for more than 300 seconds")
 	}
 	return nil
 }
 
+// ListClients returns the live clients matching the label selector, see ParseSelector.
+func (s *Server) ListClients(selector string) (clients []ClientInfo, err error) {
+	err = s.verifyOpts()
+	if err != nil {
+		return
+	}
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return
+	}
+	appIDs, err := s.store.ListClientIDs()
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, appID := range appIDs {
+		clientInfo, infoErr := s.store.GetClientInfo(appID)
+		if infoErr != nil {
+			continue
+		}
+		if now-clientInfo.LastPingTime > LIVE_EXPIRE || !sel.Matches(clientInfo.Labels) {
+			continue
+		}
+		clients = append(clients, clientInfo.ClientInfo)
+	}
+	return
+}
+
+// SelectClients returns the appIDs of the live clients matching the label selector
+func (s *Server) SelectClients(selector string) (appIDs []string, err error) {
+	clients, err := s.ListClients(selector)
+	if err != nil {
+		return
+	}
+	for _, clientInfo := range clients {
+		appIDs = append(appIDs, clientInfo.AppID)
+	}
+	return
+}
+
+// RunSelectorTask send the task to every live client matching the label selector, see RunBroadcastTask
+func (s *Server) RunSelectorTask(selector, taskType, payload string) (results map[string]*BroadcastResult, err error) {
+	appIDs, err := s.SelectClients(selector)
+	if err != nil {
+		return
+	}
+	if len(appIDs) == 0 {
+		return nil, fmt.Errorf("no live client matches selector %q", selector)
+	}
+	return s.RunBroadcastTask(appIDs, taskType, payload)
+}
+
 // registerHandler handles client registration by reading the full request body,
 // verifying the signature (which includes the body content and a date header),
-// and storing client info and metadata in Redis.
+// and storing client info and metadata in the store.
 func (s *Server) apiRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	err := s.verifyOpts()
 	if err != nil {
 		s.errorReport(w, 1, err.Error())
 		return
 	}
-	providedSign, appID, dateTime, payload, err := getRequestArgs(r)
+	// a client with a certificate of the CA registers without signature
+	var args requestArgs
+	certAppID, certAuth := s.requestCertAppID(r)
+	if certAuth {
+		args, err = getCertRequestArgs(r, "register", certAppID)
+	} else {
+		args, err = getRequestArgs(r, "register")
+	}
 	if err != nil {
 		s.errorReport(w, 1, err.Error())
 		return
 	}
-
-	// register function is the secret use default:orange-forge
-	expectedSign := s.computeSignature(appID, DEFAULT_SECRET, payload, dateTime)
-	if expectedSign != providedSign {
-		s.errorReport(w, 1, "signature verification failed")
+	args.ClientIP = s.clientIP(r)
+	appID, nonce, payload := args.AppID, args.Nonce, args.Payload
+	if !certAuth && !s.verifySignVersion(args) {
+		s.authFailed(args)
+		s.errorReport(w, 4, "signature verification failed")
+		return
+	}
+	if !certAuth && !s.verifyDateTime(appID, args.DateTime) {
+		// a skewed client clock is not a rejected credential, the client retries once its clock is fixed
+		s.errorReport(w, 5, "request time outside the accepted window, check the client clock")
 		return
 	}
 
@@ -188,93 +435,213 @@ func (s *Server) apiRegisterHandler(w http.ResponseWriter, r *http.Request) {
 		s.errorReport(w, 1, "invalid JSON")
 		return
 	}
-	if req.AppID == "" || req.Secret == "" {
+	if req.AppID == "" || req.Secret == "" || req.AppID != appID {
 		s.errorReport(w, 1, "app_id and secret are required")
 		return
 	}
-	cacheKey := GetClientInfoKey(req.AppID)
-	clientJson, _ := rdx.String(s.redisConn.Do("GET", cacheKey))
+	if err = validateLabels(req.Labels); err != nil {
+		s.errorReport(w, 1, err.Error())
+		return
+	}
+	// a certificate of the CA not recorded yet is accepted for the client on a signed registration
+	presentedCert := s.verifiedClientCert(r)
+	if presentedCert != nil && certificateAppID(presentedCert) != appID {
+		presentedCert = nil
+	}
+	if !certAuth && s.authMode == AUTH_MTLS && req.CSR == "" && presentedCert == nil {
+		s.errorReport(w, 4, "client certificate required")
+		return
+	}
+	if req.CSR != "" && (certAuth || s.ca == nil) {
+		s.errorReport(w, 1, "certificate enrollment is not available")
+		return
+	}
+	savedInfo, err := s.store.GetClientInfo(req.AppID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		s.errorReport(w, 1, err.Error())
+		return
+	}
+	registered := err == nil
+	var savedSecret, savedPrevious string
+	if registered {
+		if savedSecret, savedPrevious, err = s.openSecrets(savedInfo); err != nil {
+			s.errorReport(w, 1, err.Error())
+			return
+		}
+	}
+
+	// the request is signed with the client secret, the legacy clients sign with DEFAULT_SECRET
+	signedBy := func(secret string) bool {
+		return hmac.Equal([]byte(s.computeSignature(args, secret)), []byte(args.Sign))
+	}
+	// a replayed nonce is rejected, a store failure is reported with code 5 so that the client retries
+	checkNonce := func() bool {
+		fresh, err := s.verifyNonce(appID, nonce)
+		if err != nil {
+			s.errorReport(w, 5, "nonce verification unavailable, try again later")
+			return false
+		}
+		if !fresh {
+			s.authFailed(args)
+			s.errorReport(w, 4, "signature verification failed")
+		}
+		return fresh
+	}
+	var enrollLabels map[string]string
+	switch {
+	case certAuth:
+		// the certificate issued by the CA proves the identity
+		enrollLabels = savedInfo.EnrollLabels
+	case registered:
+		// re-registration requires the current secret, or an operator reset
+		legacySigned := s.legacyRegistration && signedBy(DEFAULT_SECRET) && req.Secret == savedSecret
+		if !signedBy(savedSecret) && !legacySigned {
+			s.authFailed(args)
+			s.errorReport(w, 4, "app already registered, re-registration requires the current secret")
+			return
+		}
+		if !checkNonce() {
+			return
+		}
+		enrollLabels = savedInfo.EnrollLabels
+	case s.legacyRegistration && r.Header.Get("X-FORGE-ENROLL") == "":
+		if !signedBy(req.Secret) && !signedBy(DEFAULT_SECRET) {
+			s.authFailed(args)
+			s.errorReport(w, 4, "signature verification failed")
+			return
+		}
+		if !checkNonce() {
+			return
+		}
+	default:
+		// the nonce is checked before a use of the token is consumed
+		if !signedBy(req.Secret) {
+			s.authFailed(args)
+			s.errorReport(w, 4, "signature verification failed")
+			return
+		}
+		if !checkNonce() {
+			return
+		}
+		token, err := s.verifyEnrollment(r, args)
+		if err != nil {
+			s.authFailed(args)
+			s.errorReport(w, authErrorCode(err), err.Error())
+			return
+		}
+		enrollLabels = token.Labels
+	}
+	if len(enrollLabels) > 0 {
+		labels := make(map[string]string, len(req.Labels)+len(enrollLabels))
+		for key, value := range req.Labels {
+			labels[key] = value
+		}
+		for key, value := range enrollLabels {
+			labels[key] = value
+		}
+		req.Labels = labels
+	}
 
 	now := time.Now().Unix()
 	clientInfo := ClientInfo{
 		AppID:              req.AppID,
-		Secret:             req.Secret,
 		RegisterTime:       now,
 		LastPingTime:       now,
 		DoStatus:           "registered",
 		ProcessedTaskCount: 0,
+		Labels:             req.Labels,
+		EnrollLabels:       enrollLabels,
 	}
 
-	if clientJson != "" {
-		json.Unmarshal([]byte(clientJson), &clientInfo)
+	previousSecret := ""
+	if registered {
+		clientInfo = savedInfo.ClientInfo
 		clientInfo.AppID = req.AppID
-		clientInfo.Secret = req.Secret
 		clientInfo.LastPingTime = now
+		clientInfo.Labels = req.Labels
+		previousSecret = savedPrevious
 	}
 
-	infoJSON, err := json.Marshal(clientInfo)
-	if err != nil {
-		s.errorReport(w, 1, "failed to marshal client info")
+	record := ClientRecord{ClientInfo: clientInfo}
+	switch {
+	case presentedCert != nil:
+		record.CertSerial = certSerial(presentedCert)
+	case registered:
+		record.CertSerial = savedInfo.CertSerial
+	}
+	resp := RegistrationResponse{ClientInfo: clientInfo}
+	if req.CSR != "" {
+		certPEM, err := s.ca.SignCSR([]byte(req.CSR), appID)
+		if err != nil {
+			s.errorReport(w, 1, err.Error())
+			return
+		}
+		if record.CertSerial, err = pemCertSerial(certPEM); err != nil {
+			s.errorReport(w, 1, err.Error())
+			return
+		}
+		resp.Certificate = string(certPEM)
+	}
+
+	if err = s.sealSecrets(&record, req.Secret, previousSecret); err != nil {
+		s.errorReport(w, 1, err.Error())
 		return
 	}
-	_, err = s.redisConn.Do("SETEX", GetClientInfoKey(req.AppID), RDX_EXPIRE, infoJSON)
+	err = s.store.SaveClientInfo(record, RDX_EXPIRE*time.Second)
 	if err != nil {
 		s.errorReport(w, 1, err.Error())
 		return
 	}
 
-	//  hide secret for response
-	clientInfo.Secret = "***"
-	writeJSON(w, Response{Code: 0, Message: "registration successful", Data: clientInfo})
+	writeJSON(w, Response{Code: 0, Message: "registration successful", Data: resp})
 }
 
 // pingHandler handles client pings by verifying the signature and updating the client's last ping time.
 func (s *Server) apiPingHandler(w http.ResponseWriter, r *http.Request) {
-	providedSign, appID, dateTime, reqBody, err := getRequestArgs(r)
+	args, err := s.authenticate(r, "ping")
 	if err != nil {
-		s.errorReport(w, 1, err.Error())
-		return
-	}
-	if !s.verifySignature(appID, reqBody, dateTime, providedSign) {
-		s.errorReport(w, 1, "signature verification failed")
+		s.errorReport(w, authErrorCode(err), err.Error())
 		return
 	}
+	appID := args.AppID
 	if s.IsDebug {
-		log.Println("[debug] pingHandler", appID, reqBody, dateTime)
+		log.Println("[debug] pingHandler", appID, args.Payload, args.DateTime)
 	}
 
-	cacheKey := GetClientInfoKey(appID)
-	clientJson, _ := rdx.String(s.redisConn.Do("GET", cacheKey))
-	clientInfo := ClientInfo{}
-	now := time.Now().Unix()
+	err = s.store.TouchClient(appID, time.Now(), RDX_EXPIRE*time.Second)
+	if err != nil {
+		s.errorReport(w, 1, err.Error())
+		return
+	}
 
-	if clientJson != "" {
-		_ = json.Unmarshal([]byte(clientJson), &clientInfo)
-		clientInfo.LastPingTime = now
-		clientInfo.DoStatus = "registered"
+	// the tasks still handled by the client are not requeued by the reaper
+	pingReq := PingRequest{}
+	_ = json.Unmarshal([]byte(args.Payload), &pingReq)
+	for _, taskID := range pingReq.Tasks {
+		if _, err = s.store.ExtendLock(appID, taskID, s.lockTimeout); err != nil {
+			s.errorReport(w, 1, err.Error())
+			return
+		}
 	}
-	infoJSON, err := json.Marshal(clientInfo)
+
+	cancelTasks, err := s.store.PopCancels(appID)
 	if err != nil {
-		s.errorReport(w, 1, "failed to marshal client info")
+		s.errorReport(w, 1, err.Error())
 		return
 	}
-	_, err = s.redisConn.Do("SETEX", GetClientInfoKey(appID), RDX_EXPIRE, infoJSON)
 
-	writeJSON(w, Response{Code: 0, Message: "pong", Data: "pong"})
+	writeJSON(w, Response{Code: 0, Message: "pong", Data: PingResponse{Message: "pong", CancelTasks: cancelTasks}})
 	return
 }
 
 // apiPushTaskStatus client return task information
 func (s *Server) apiPushTaskStatus(w http.ResponseWriter, r *http.Request) {
-	providedSign, appID, dateTime, reqBody, err := getRequestArgs(r)
+	args, err := s.authenticate(r, "reportTask")
 	if err != nil {
-		s.errorReport(w, 1, err.Error())
-		return
-	}
-	if !s.verifySignature(appID, reqBody, dateTime, providedSign) {
-		s.errorReport(w, 1, "signature verification failed")
+		s.errorReport(w, authErrorCode(err), err.Error())
 		return
 	}
+	appID, reqBody := args.AppID, args.Payload
 	taskReciveData := Task{}
 	_ = json.Unmarshal([]byte(reqBody), &taskReciveData)
 	if taskReciveData.TaskID == "" {
@@ -282,65 +649,143 @@ func (s *Server) apiPushTaskStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	taskKey := "client:" + appID + ":task:" + taskReciveData.TaskID
-	taskJSON, err := rdx.Bytes(s.redisConn.Do("GET", taskKey))
+	saveTaskInfo, err := s.store.GetTask(appID, taskReciveData.TaskID)
 	if err != nil {
 		s.errorReport(w, 1, "task info not found,"+err.Error())
 		return
 	}
-	saveTaskInfo := Task{}
-	_ = json.Unmarshal(taskJSON, &saveTaskInfo)
+	if saveTaskInfo.DoStatus == STATUS_CANCELLED || saveTaskInfo.DoStatus == STATUS_DEAD {
+		// the waiter already received the terminal status, a late report of the client must not overwrite it
+		if s.IsDebug {
+			log.Println("[DEBUG] ignore report of a terminal task:", appID, taskReciveData.TaskID, saveTaskInfo.DoStatus)
+		}
+		writeJSON(w, Response{Code: 0, Message: "task is " + saveTaskInfo.DoStatus + ", report ignored"})
+		return
+	}
 	saveTaskInfo.DoStatus = taskReciveData.DoStatus
+	saveTaskInfo.Result = taskReciveData.Result
+	saveTaskInfo.Error = taskReciveData.Error
 
-	saveTaskInfoJson, _ := json.Marshal(saveTaskInfo)
-	_, err = s.redisConn.Do("SETEX", taskKey, RDX_EXPIRE, saveTaskInfoJson)
+	err = s.store.SaveTask(appID, saveTaskInfo, RDX_EXPIRE*time.Second)
 	if err != nil {
 		s.errorReport(w, 1, err.Error())
 		return
 	}
 
+	if taskReciveData.DoStatus != STATUS_DOING && saveTaskInfo.Continuous {
+		// close the message stream of a continuous task
+		msgType, content := SUCC_TYPE, taskReciveData.Result
+		if taskReciveData.DoStatus != STATUS_SUCCESS {
+			msgType = ERR_TYPE
+			if taskReciveData.Error != "" {
+				content = taskReciveData.Error
+			}
+		}
+		err = s.pushTaskMessage(appID, TaskMessage{
+			TaskID:   taskReciveData.TaskID,
+			MsgType:  msgType,
+			Content:  content,
+			Done:     true,
+			CreateAt: time.Now(),
+
+			Encrypted: saveTaskInfo.Encrypted,
+		})
+		if err != nil {
+			s.errorReport(w, 1, err.Error())
+			return
+		}
+	}
+
 	if taskReciveData.DoStatus != STATUS_DOING {
 		// remove task process key
-		procQueueKey := "client:" + appID + ":processing_queue"
-		s.redisConn.Do("LREM", procQueueKey, 1, taskReciveData.TaskID)
+		_, _ = s.store.RemoveProcessing(appID, taskReciveData.TaskID)
 		if s.IsDebug {
-			log.Println("[DEBUG] LREM:", procQueueKey, taskReciveData.TaskID)
+			log.Println("[DEBUG] remove processing:", appID, taskReciveData.TaskID)
 		}
 	}
 
-	if _, ok := s.taskChan[taskReciveData.TaskID]; ok {
-		s.taskChan[taskReciveData.TaskID] <- taskReciveData
+	if taskReciveData.DoStatus != STATUS_DOING {
+		// wake the waiter on whichever replica submitted the task
+		err = s.store.PushResult(appID, saveTaskInfo, RESULT_EXPIRE*time.Second)
+		if err != nil {
+			s.errorReport(w, 1, err.Error())
+			return
+		}
 	}
 
 	writeJSON(w, Response{Code: 0, Message: "task status updated successfully"})
 	return
 }
 
+// apiPushTaskMessage client push an intermediate message of a continuous task
+func (s *Server) apiPushTaskMessage(w http.ResponseWriter, r *http.Request) {
+	args, err := s.authenticate(r, "reportMessage")
+	if err != nil {
+		s.errorReport(w, authErrorCode(err), err.Error())
+		return
+	}
+	appID, reqBody := args.AppID, args.Payload
+	msg := TaskMessage{}
+	_ = json.Unmarshal([]byte(reqBody), &msg)
+	if msg.TaskID == "" {
+		writeJSON(w, Response{Code: 1, Message: "task message not found"})
+		return
+	}
+	switch msg.MsgType {
+	case LOG_TYPE, ERR_TYPE, SUCC_TYPE:
+	default:
+		s.errorReport(w, 1, "invalid message type")
+		return
+	}
+
+	taskInfo, err := s.store.GetTask(appID, msg.TaskID)
+	if err != nil {
+		s.errorReport(w, 1, "task info not found,"+err.Error())
+		return
+	}
+	if !taskInfo.Continuous {
+		s.errorReport(w, 1, "task is not continuous")
+		return
+	}
+
+	// only the server closes the stream, when the task status is reported
+	msg.Done = false
+	msg.Encrypted = taskInfo.Encrypted
+	if msg.CreateAt.IsZero() {
+		msg.CreateAt = time.Now()
+	}
+	if err = s.pushTaskMessage(appID, msg); err != nil {
+		s.errorReport(w, 1, err.Error())
+		return
+	}
+
+	writeJSON(w, Response{Code: 0, Message: "task message received"})
+}
+
+// pushTaskMessage append a message to the stream of a continuous task
+func (s *Server) pushTaskMessage(appID string, msg TaskMessage) error {
+	return s.store.PushMessage(appID, msg, RDX_EXPIRE*time.Second)
+}
+
 // apiGetTaskHandler implements long-polling to fetch tasks.
-// It first attempts an immediate RPOPLPUSH; if no task is available,
+// It first attempts an immediate PopTask; if no task is available,
 // it subscribes to the client's task channel and waits up to x seconds.
 // When a notification is received, it attempts to fetch and lock a task.
 func (s *Server) apiGetTaskHandler(w http.ResponseWriter, r *http.Request) {
-	providedSign, appID, dateTime, payload, err := getRequestArgs(r)
+	args, err := s.authenticate(r, "getTask")
 	if err != nil {
-		s.errorReport(w, 1, err.Error())
-		return
-	}
-	if !s.verifySignature(appID, payload, dateTime, providedSign) {
-		s.errorReport(w, 1, "signature verification failed")
+		s.errorReport(w, authErrorCode(err), err.Error())
 		return
 	}
-
-	queueKey := "client:" + appID + ":task_queue"
-	procQueueKey := "client:" + appID + ":processing_queue"
+	appID := args.AppID
 
 	ctx, cancel := context.WithTimeout(context.Background(), s.longLoopDuration)
 	defer cancel()
 
 	// 尝试立即获取任务
-	taskID, err := rdx.String(s.redisConn.Do("RPOPLPUSH", queueKey, procQueueKey))
+	taskID, err := s.store.PopTask(appID)
 	if err == nil && taskID != "" {
-		s.processTask(w, appID, taskID, procQueueKey)
+		s.processTask(w, appID, taskID)
 		return
 	}
 
@@ -355,7 +800,7 @@ func (s *Server) apiGetTaskHandler(w http.ResponseWriter, r *http.Request) {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				taskID, err := rdx.String(s.redisConn.Do("RPOPLPUSH", queueKey, procQueueKey))
+				taskID, err := s.store.PopTask(appID)
 				if err == nil && taskID != "" {
 					// 非阻塞发送
 					taskResultChan <- taskID
@@ -368,7 +813,7 @@ func (s *Server) apiGetTaskHandler(w http.ResponseWriter, r *http.Request) {
 	// 等待任务结果或超时
 	select {
 	case tid := <-taskResultChan:
-		s.processTask(w, appID, tid, procQueueKey)
+		s.processTask(w, appID, tid)
 		return
 	case <-ctx.Done():
 		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
@@ -380,86 +825,101 @@ func (s *Server) apiGetTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// addTask creates a new task for a specific client, stores it in Redis, and pushes its taskID into the client's task queue.
+// addTask creates a new task for a specific client, stores it in the store, and pushes its taskID into the client's task queue.
 func (s *Server) addTask(appID, taskType, payload string) (string, error) {
-	taskID := uuid.New().String()
-	task := Task{
-		TaskID:   taskID,
-		TaskType: taskType,
-		CreateAt: time.Now(),
-		Payload:  payload,
-	}
-	taskJSON, err := json.Marshal(task)
-	if err != nil {
+	return s.pushTask(appID, Task{TaskType: taskType, Payload: payload})
+}
+
+// pushTask checks a task submitted through the public API and queues it, see enqueueTask.
+func (s *Server) pushTask(appID string, task Task) (string, error) {
+	if err := checkTaskType(task.TaskType); err != nil {
 		return "", err
 	}
-	taskKey := "client:" + appID + ":task:" + taskID
-	if _, err = s.redisConn.Do("SETEX", taskKey, RDX_EXPIRE, taskJSON); err != nil {
+	if err := s.authorizeTask(appID, task.TaskType, task.Payload); err != nil {
 		return "", err
 	}
-	queueKey := "client:" + appID + ":task_queue"
-	if _, err = s.redisConn.Do("LPUSH", queueKey, taskID); err != nil {
+	return s.enqueueTask(appID, task)
+}
+
+// enqueueTask fills the identity of the task, stores it and pushes its taskID into the client's queue of the task priority.
+// It skips the checks of pushTask, the internal forge: tasks are only queued through it.
+func (s *Server) enqueueTask(appID string, task Task) (string, error) {
+	if task.TaskID == "" {
+		task.TaskID = uuid.New().String()
+	}
+	task.CreateAt = time.Now()
+	task.Priority = normalizePriority(task.Priority)
+	if s.encryptPayload && !task.Encrypted {
+		if err := s.sealTask(appID, &task); err != nil {
+			return "", err
+		}
+	}
+	if s.taskSigningKey != nil {
+		task.Signature = signTask(s.taskSigningKey, appID, task)
+	}
+	err := s.store.SaveTask(appID, task, RDX_EXPIRE*time.Second)
+	if err != nil {
+		return "", err
+	}
+	if err = s.store.PushTask(appID, task.TaskID, task.Priority); err != nil {
 		return "", err
 	}
-	return taskID, err
+	return task.TaskID, err
 }
 
 // processTask attempts to retrieve task details, acquire a lock, and return the task.
-func (s *Server) processTask(w http.ResponseWriter, appID, taskID, procQueueKey string) {
-	taskKey := "client:" + appID + ":task:" + taskID
-	taskJSON, err := rdx.Bytes(s.redisConn.Do("GET", taskKey))
+func (s *Server) processTask(w http.ResponseWriter, appID, taskID string) {
+	task, err := s.store.GetTask(appID, taskID)
 	if err != nil {
 		s.errorReport(w, 1, err.Error())
 
 		return
 	}
-	var task Task
-	if err = json.Unmarshal(taskJSON, &task); err != nil {
-		s.errorReport(w, 1, "invalid task data")
+	if task.DoStatus == STATUS_CANCELLED {
+		// cancelled before delivery
+		_, _ = s.store.RemoveProcessing(appID, taskID)
+		s.errorReport(w, 2, "task is cancelled")
 		return
 	}
 
-	// Use SETNX to acquire a lock for the task.
-	lockKey := "lock:client:" + appID + ":task:" + task.TaskID
-	locked, err := rdx.Int(s.redisConn.Do("SETNX", lockKey, "1"))
-	if err != nil || locked != 1 {
+	// Acquire a lock for the task with an expiration (e.g., 120 seconds).
+	locked, err := s.store.AcquireLock(appID, task.TaskID, s.lockTimeout)
+	if err != nil || !locked {
 		// If lock not acquired, remove the task from the processing queue.
-		s.redisConn.Do("LREM", procQueueKey, 1, taskID)
+		_, _ = s.store.RemoveProcessing(appID, taskID)
 		if s.IsDebug {
-			log.Println("[DEBUG] LREM:", procQueueKey)
+			log.Println("[DEBUG] remove processing:", appID, taskID)
 		}
 		//w.WriteHeader(http.StatusNoContent)
 		s.errorReport(w, 2, "task is already being processed or lock acquisition failed")
 		return
 	}
-	// Set an expiration for the lock (e.g., 120 seconds).
-	s.redisConn.Do("EXPIRE", lockKey, 120)
+	task.Attempts++
+	task.DeliverAt = time.Now()
+	if err = s.store.SaveTask(appID, task, RDX_EXPIRE*time.Second); err != nil {
+		s.errorReport(w, 1, err.Error())
+		return
+	}
 	writeJSON(w, Response{Code: 0, Message: "task fetched", Data: task})
 }
 
-// computeSignature calculates HMAC-SHA256 signature using appID, payload, and dateTime.
-func (s *Server) computeSignature(appID, secret, payload, dateTime string) string {
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(appID + payload + dateTime))
-	sign := hex.EncodeToString(h.Sum(nil))
+// computeSignature calculates HMAC-SHA256 signature of the request for its signature version.
+func (s *Server) computeSignature(args requestArgs, secret string) string {
+	signData := args.stringToSign()
+	sign := hmacSign(secret, signData)
 	if s.IsDebug {
-		log.Println("signed before:", appID+payload+dateTime)
+		log.Println("signed before:", signData)
 		log.Println("sign string:", sign)
 	}
 	return sign
 }
 
-// verifySignature retrieves the client's secret from Redis, validates the timestamp,
-// and compares the expected signature with the provided one.
+// verifySignature retrieves the client's secret from the store, validates the timestamp,
+// compares the expected signature with the provided one and rejects a replayed nonce.
 // The dateTime must be in the format "2006-01-02 15:04:05" and within a +/-5 minutes window.
-func (s *Server) verifySignature(appID, payload, dateTime, providedSign string) bool {
-	t := DateToTm(dateTime)
-
-	now := time.Now()
-	if now.Sub(t) > 5*time.Minute || t.Sub(now) > 5*time.Minute {
-		if s.IsDebug {
-			log.Println("[debug] requset datetime invalid", appID, dateTime)
-		}
+func (s *Server) verifySignature(args requestArgs) bool {
+	appID := args.AppID
+	if !s.verifySignVersion(args) || !s.verifyDateTime(appID, args.DateTime) {
 		return false
 	}
 
@@ -469,34 +929,88 @@ func (s *Server) verifySignature(appID, payload, dateTime, providedSign string)
 		return false
 	}
 
-	expectedSign := s.computeSignature(clientInfo.AppID, clientInfo.Secret, payload, dateTime)
+	secrets, err := s.secretCandidates(clientInfo)
+	if err != nil {
+		consoleRouter("[ERROR]", fmt.Sprintf("open client secret error: %v", err))
+		return false
+	}
+	// the previous secret is accepted during the grace window of a rotation
+	for _, secret := range secrets {
+		expectedSign := s.computeSignature(args, secret)
+		if s.IsDebug {
+			log.Printf("[debug] expectedSign: %v, input:%v  ismatch:%v", expectedSign, args.Sign, expectedSign == args.Sign)
+		}
+		if hmac.Equal([]byte(expectedSign), []byte(args.Sign)) {
+			fresh, err := s.verifyNonce(appID, args.Nonce)
+			return err == nil && fresh
+		}
+	}
+	return false
+}
+
+// verifySignVersion accepts v2 signatures, and v1 signatures until the end of the migration period
+func (s *Server) verifySignVersion(args requestArgs) bool {
+	switch args.SignVersion {
+	case SIGN_V2:
+		return true
+	case SIGN_V1:
+		if s.signV1Until.IsZero() || time.Now().Before(s.signV1Until) {
+			return true
+		}
+	}
 	if s.IsDebug {
-		log.Printf("[debug] expectedSign: %v, input:%v  ismatch:%v", expectedSign, providedSign, expectedSign == providedSign)
+		log.Println("[debug] signature version rejected", args.AppID, args.SignVersion)
 	}
-	return expectedSign == providedSign
+	return false
 }
 
-// refreshClientInfo get client info and refresh status
-func (s *Server) refreshClientInfo(appID string) (info ClientInfo, err error) {
-	clientKey := GetClientInfoKey(appID)
-	clientInfoJSON, err := rdx.Bytes(s.redisConn.Do("GET", clientKey))
+// verifyNonce records the nonce of a signed request, a nonce already seen within the time window is a replay
+func (s *Server) verifyNonce(appID, nonce string) (fresh bool, err error) {
+	if nonce == "" {
+		// v1 clients released before the nonce, accepted until the end of the signature migration
+		return true, nil
+	}
+	fresh, err = s.store.MarkNonce(appID, nonce, 10*time.Minute)
 	if err != nil {
-		return
+		consoleRouter("[ERROR]", fmt.Sprintf("MarkNonce error: %v", err))
+		return false, err
 	}
-	if err = json.Unmarshal(clientInfoJSON, &info); err != nil {
-		return
+	if !fresh && s.IsDebug {
+		log.Println("[debug] replayed request nonce", appID, nonce)
 	}
+	return
+}
 
-	info.LastPingTime = time.Now().Unix()
+// verifyDateTime checks the request time is within a +/-5 minutes window
+func (s *Server) verifyDateTime(appID, dateTime string) bool {
+	t := DateToTm(dateTime)
 
-	infoJSON, err := json.Marshal(info)
+	now := time.Now()
+	if now.Sub(t) > 5*time.Minute || t.Sub(now) > 5*time.Minute {
+		if s.IsDebug {
+			log.Println("[debug] requset datetime invalid", appID, dateTime)
+		}
+		return false
+	}
+	return true
+}
+
+// refreshClientInfo get client info and record its ping time, the secrets are only rewritten
+// to seal them with a new master key
+func (s *Server) refreshClientInfo(appID string) (info ClientRecord, err error) {
+	info, err = s.store.GetClientInfo(appID)
 	if err != nil {
 		return
 	}
-	_, err = s.redisConn.Do("SETEX", GetClientInfoKey(appID), 86400, infoJSON)
-	if err != nil {
+
+	now := time.Now()
+	if err = s.store.TouchClient(appID, now, RDX_EXPIRE*time.Second); err != nil {
 		return
 	}
+	info.LastPingTime = now.Unix()
+	if info.KeyID != s.masterKeyID {
+		err = s.saveClient(info, RDX_EXPIRE*time.Second)
+	}
 	return
 }
 
@@ -511,8 +1025,8 @@ func (s *Server) processPayloads() {
 }
 
 func (s *Server) verifyOpts() (err error) {
-	if s.redisConn == nil {
-		err = errors.New("redis connection not found")
+	if s.store == nil {
+		err = errors.New("store not found, use WithRdx or WithStore")
 	}
 	if s.statusFunc == nil {
 		err = errors.New("must register StatusFunc use WithStatusFunc")
@@ -530,12 +1044,31 @@ func (s *Server) errorReport(w http.ResponseWriter, code int, message string) {
 	writeJSON(w, Response{Code: code, Message: message})
 }
 
-func getRequestArgs(r *http.Request) (providedSign, appID, dateTime, payload string, err error) {
-	providedSign = r.Header.Get("X-FORGE-SIGN")
-	appID = r.Header.Get("X-FORGE-APPID")
-	dateTime = r.Header.Get("X-FORGE-TIME")
-	if appID == "" || providedSign == "" || dateTime == "" {
-		err = errors.New("appid, sign, and time are required")
+// getRequestArgs reads the signed headers and the body of the request to the api route
+func getRequestArgs(r *http.Request, api string) (args requestArgs, err error) {
+	args = requestArgs{
+		Sign:        r.Header.Get("X-FORGE-SIGN"),
+		SignVersion: r.Header.Get("X-FORGE-SIGN-VERSION"),
+		AppID:       r.Header.Get("X-FORGE-APPID"),
+		DateTime:    r.Header.Get("X-FORGE-TIME"),
+		Nonce:       r.Header.Get("X-FORGE-NONCE"),
+		Method:      r.Method,
+		Route:       apiRoutes[api],
+	}
+	if args.SignVersion == "" {
+		args.SignVersion = SIGN_V1
+	}
+	if args.AppID == "" || args.Sign == "" || args.DateTime == "" {
+		err = errors.New("appid, sign and time are required")
+		return
+	}
+	if args.Nonce == "" && args.SignVersion != SIGN_V1 {
+		// only the v1 clients released before the nonce omit it
+		err = errors.New("nonce is required")
+		return
+	}
+	if len(args.Nonce) > 64 {
+		err = errors.New("nonce is too long")
 		return
 	}
 
@@ -545,7 +1078,7 @@ func getRequestArgs(r *http.Request) (providedSign, appID, dateTime, payload str
 		err = errors.New("failed to read request body")
 		return
 	}
-	payload = string(body)
+	args.Payload = string(body)
 
 	return
 }
@@ -567,18 +1100,21 @@ func (s *Server) Handler() http.Handler {
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc(apiRoutes["register"], s.apiRegisterHandler)
+	mux.HandleFunc(apiRoutes["register"], s.limit("register", s.apiRegisterHandler))
 	consoleRouter("POST", apiRoutes["register"])
 
-	mux.HandleFunc(apiRoutes["ping"], s.apiPingHandler)
+	mux.HandleFunc(apiRoutes["ping"], s.limit("ping", s.apiPingHandler))
 	consoleRouter("POST", apiRoutes["ping"])
 
-	mux.HandleFunc(apiRoutes["getTask"], s.apiGetTaskHandler)
+	mux.HandleFunc(apiRoutes["getTask"], s.limit("getTask", s.apiGetTaskHandler))
 	consoleRouter("POST", apiRoutes["getTask"])
 
-	mux.HandleFunc(apiRoutes["reportTask"], s.apiPushTaskStatus)
+	mux.HandleFunc(apiRoutes["reportTask"], s.limit("reportTask", s.apiPushTaskStatus))
 	consoleRouter("POST", apiRoutes["reportTask"])
 
+	mux.HandleFunc(apiRoutes["reportMessage"], s.limit("reportMessage", s.apiPushTaskMessage))
+	consoleRouter("POST", apiRoutes["reportMessage"])
+
 	//mux.HandleFunc(apiRoutes["reportTask"], s.reportTaskHandler)
 	s.httpMux = mux
 	return mux
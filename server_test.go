@@ -0,0 +1,308 @@
+package forge_connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server on a MemoryStore behind an httptest server, with short polling ticks.
+// Clients register without enrollment token, see enrollment_test.go for the enrollment.
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	s := NewServer("test").
+		WithStore(NewMemoryStore()).
+		WithLegacyRegistration(true).
+		SetTaskWaitTick(10 * time.Millisecond)
+	s.longLoopDuration = 200 * time.Millisecond
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// newTestClient returns a client of the test server, its secret is derived from the appID
+func newTestClient(ts *httptest.Server, appID string) *Client {
+	return NewForge(appID, "secret-"+appID).SetServerAddr(ts.URL)
+}
+
+// registerTestClient registers the appID without starting the polling of the client
+func registerTestClient(t *testing.T, ts *httptest.Server, appID string) *Client {
+	return registerClient(t, newTestClient(ts, appID))
+}
+
+// registerClient registers the client without starting its polling
+func registerClient(t *testing.T, c *Client) *Client {
+	if err := sendRegistration(c); err != nil {
+		t.Fatal("register:", err)
+	}
+	return c
+}
+
+// sendRegistration sends the registration request of the client
+func sendRegistration(c *Client) error {
+	params, _ := json.Marshal(RegistrationRequest{AppID: c.AppID, Secret: c.secret, Labels: c.labels})
+	_, _, err := c.SendHTTPRequest("register", string(params))
+	return err
+}
+
+// fetchTestTask polls the next task of the client
+func fetchTestTask(t *testing.T, c *Client) *Task {
+	task, _, err := c.GetTask()
+	if err != nil {
+		t.Fatal("GetTask:", err)
+	}
+	return task
+}
+
+func TestRunSingleTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, body, err := s.RunSingleTask("app-1", "echo", "hello")
+		done <- result{body, err}
+	}()
+
+	task := fetchTestTask(t, c)
+	if task.TaskType != "echo" || task.Payload != "hello" {
+		t.Fatalf("fetched task = %+v", task)
+	}
+	task.Result, task.DoStatus = "echo:"+task.Payload, STATUS_SUCCESS
+	c.pushTaskResult(task)
+
+	if r := <-done; r.err != nil || r.body != "echo:hello" {
+		t.Fatalf("RunSingleTask = %q, %v", r.body, r.err)
+	}
+	if _, _, err := s.RunSingleTask("app-2", "echo", "hello"); err == nil {
+		t.Fatal("task of an unregistered client accepted")
+	}
+}
+
+func TestRunSingleTaskResultFromOtherReplica(t *testing.T) {
+	submitter, ts := newTestServer(t)
+	// the second replica shares the store of the first one
+	replica := NewServer("replica").WithStore(submitter.store)
+	replica.longLoopDuration = 200 * time.Millisecond
+	replicaTS := httptest.NewServer(replica.Handler())
+	defer replicaTS.Close()
+	c := registerTestClient(t, ts, "app-1")
+
+	done := make(chan string, 1)
+	go func() {
+		_, body, _ := submitter.RunSingleTask("app-1", "echo", "hello")
+		done <- body
+	}()
+	task := fetchTestTask(t, c)
+	task.Result, task.DoStatus = "from replica", STATUS_SUCCESS
+	c.SetServerAddr(replicaTS.URL).pushTaskResult(task)
+
+	select {
+	case body := <-done:
+		if body != "from replica" {
+			t.Fatalf("RunSingleTask = %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("result reported to the other replica not received")
+	}
+}
+
+func TestContinuousTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+
+	taskID, messages, err := s.ContinuousTask("app-1", "tail", "app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := fetchTestTask(t, c)
+	if task.TaskID != taskID || !task.Continuous {
+		t.Fatalf("fetched task = %+v", task)
+	}
+	for _, line := range []string{"line 1", "line 2"} {
+		if err = c.PushTaskMessage(taskID, LOG_TYPE, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	task.Result, task.DoStatus = "eof", STATUS_SUCCESS
+	c.pushTaskResult(task)
+
+	var got []TaskMessage
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, msg)
+		case <-timeout:
+			t.Fatal("stream not closed")
+		}
+	}
+	if len(got) != 3 || got[0].Content != "line 1" || got[1].Content != "line 2" {
+		t.Fatalf("messages = %+v", got)
+	}
+	if last := got[2]; !last.Done || last.MsgType != SUCC_TYPE || last.Content != "eof" {
+		t.Fatalf("terminal message = %+v", last)
+	}
+}
+
+func TestCancelPendingTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	taskID, err := s.addTask("app-1", "backup", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CancelTask("app-1", taskID); err != nil {
+		t.Fatal(err)
+	}
+	if _, errno, err := c.GetTask(); err == nil || errno != 2 {
+		t.Fatalf("GetTask of a cancelled task = %v, errno %d", err, errno)
+	}
+	if err = s.CancelTask("app-1", taskID); err == nil {
+		t.Fatal("second CancelTask succeeded")
+	}
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		<-ctx.Done()
+		return "stopped", nil
+	}
+
+	done := make(chan error, 1)
+	var taskID string
+	go func() {
+		var err error
+		taskID, _, err = s.RunSingleTask("app-1", "backup", "")
+		done <- err
+	}()
+	task := fetchTestTask(t, c)
+	finished := make(chan struct{})
+	go func() {
+		c.runTask(task)
+		close(finished)
+	}()
+
+	if err := s.CancelTask("app-1", task.TaskID); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("RunSingleTask of a cancelled task succeeded")
+	}
+	// the cancel signal reaches the handler on the next ping
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context not cancelled")
+	}
+	if stored, err := s.store.GetTask("app-1", taskID); err != nil || stored.DoStatus != STATUS_CANCELLED {
+		t.Fatalf("stored task = %+v, %v", stored, err)
+	}
+}
+
+func TestTaskHandlerFailures(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		if task.TaskType == "panic" {
+			panic("handler bug")
+		}
+		return "partial", errors.New("disk full")
+	}
+
+	for _, tt := range []struct {
+		taskType string
+		message  string
+	}{
+		{"fail", "disk full"},
+		{"panic", "panic: handler bug"},
+	} {
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := s.RunSingleTask("app-1", tt.taskType, "")
+			done <- err
+		}()
+		c.runTask(fetchTestTask(t, c))
+
+		var taskErr *TaskError
+		err := <-done
+		if !errors.As(err, &taskErr) || taskErr.Status != STATUS_FAILED || !strings.HasPrefix(taskErr.Message, tt.message) {
+			t.Errorf("%s task error = %v", tt.taskType, err)
+		}
+	}
+}
+
+func TestTaskPriorities(t *testing.T) {
+	s, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+	for _, task := range []Task{
+		{TaskType: "low", Priority: PRIORITY_LOW},
+		{TaskType: "normal"},
+		{TaskType: "high", Priority: PRIORITY_HIGH},
+		{TaskType: "clamped", Priority: 10},
+	} {
+		if _, err := s.pushTask("app-1", task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"clamped", "high", "normal", "low"} {
+		if task := fetchTestTask(t, c); task.TaskType != want {
+			t.Fatalf("delivered %s, want %s", task.TaskType, want)
+		}
+	}
+}
+
+func TestReportOfTerminalTaskIgnored(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.WithLockTimeout(50 * time.Millisecond).WithMaxAttempts(1)
+	c := registerTestClient(t, ts, "app-1")
+	cancelledID, err := s.addTask("app-1", "backup", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled := fetchTestTask(t, c)
+	if err = s.CancelTask("app-1", cancelledID); err != nil {
+		t.Fatal(err)
+	}
+	deadID, err := s.addTask("app-1", "restore", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := fetchTestTask(t, c)
+	time.Sleep(100 * time.Millisecond)
+	if _, count, err := s.ReapTasks(); err != nil || count != 1 {
+		t.Fatalf("ReapTasks = %d dead, %v", count, err)
+	}
+
+	// the client finishes both tasks late, their terminal status is kept
+	for taskID, want := range map[string]string{cancelledID: STATUS_CANCELLED, deadID: STATUS_DEAD} {
+		task := cancelled
+		if taskID == deadID {
+			task = dead
+		}
+		task.Result, task.DoStatus = "done", STATUS_SUCCESS
+		c.pushTaskResult(task)
+		if stored, err := s.store.GetTask("app-1", taskID); err != nil || stored.DoStatus != want {
+			t.Errorf("stored task after the late report = %+v, %v, want %s", stored, err, want)
+		}
+	}
+	if remaining := c.flushResults(context.Background()); remaining != 0 {
+		t.Fatalf("ignored reports kept for flushResults: %d", remaining)
+	}
+}
@@ -0,0 +1,109 @@
+package forge_connect
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// signature versions, announced with the X-FORGE-SIGN-VERSION header
+const (
+	SIGN_V1 = "1" // HMAC of appID + payload + dateTime + nonce, the oldest clients send no nonce
+	SIGN_V2 = "2" // HMAC of the canonical request, see canonicalRequest
+)
+
+// requestArgs are the signed headers and body of a client request
+type requestArgs struct {
+	Sign        string
+	SignVersion string
+	AppID       string
+	DateTime    string
+	Nonce       string
+	Method      string
+	Route       string
+	Payload     string
+	ClientIP    string // Source IP, for the lockout of failed authentications
+}
+
+// canonicalRequest builds the v2 string to sign, the body is represented by its SHA-256
+// so the method and the route are bound to the signature as well.
+func canonicalRequest(method, route, appID, dateTime, nonce, payload string) string {
+	bodyHash := sha256.Sum256([]byte(payload))
+	return strings.Join([]string{
+		"FORGE-HMAC-SHA256-V2",
+		strings.ToUpper(method),
+		route,
+		appID,
+		dateTime,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// stringToSign returns the signed string of the request for its signature version
+func (args requestArgs) stringToSign() string {
+	if args.SignVersion == SIGN_V2 {
+		return canonicalRequest(args.Method, args.Route, args.AppID, args.DateTime, args.Nonce, args.Payload)
+	}
+	return args.AppID + args.Payload + args.DateTime + args.Nonce
+}
+
+// hmacSign returns the hex HMAC-SHA256 of data
+func hmacSign(secret, data string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalTask builds the string the server signs for a task sent to appID,
+// the payload is signed as delivered, encrypted or not
+func canonicalTask(appID string, task Task) string {
+	payloadHash := sha256.Sum256([]byte(task.Payload))
+	return strings.Join([]string{
+		"FORGE-TASK-ED25519",
+		appID,
+		task.TaskID,
+		task.TaskType,
+		task.CreateAt.UTC().Format(time.RFC3339Nano),
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+}
+
+// signTask returns the base64 Ed25519 signature of the task
+func signTask(key ed25519.PrivateKey, appID string, task Task) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(canonicalTask(appID, task))))
+}
+
+// WithTaskSigningKey sign every task with the Ed25519 key, clients pinning the public key
+// with SetTaskPublicKey refuse tasks which were not created by the server.
+func (s *Server) WithTaskSigningKey(key ed25519.PrivateKey) *Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.taskSigningKey = key
+	return s
+}
+
+// verifyTask checks the server signature and the age of the task when a task public key is pinned
+func (c *Client) verifyTask(task *Task) error {
+	c.mu.Lock()
+	key, maxAge := c.taskPublicKey, c.taskMaxAge
+	c.mu.Unlock()
+	if key == nil {
+		return nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(task.Signature)
+	if err != nil || !ed25519.Verify(key, []byte(canonicalTask(c.AppID, *task)), signature) {
+		consoleLog("ERROR", "task signature verification failed, taskID: %s", task.TaskID)
+		return errors.New("task signature verification failed")
+	}
+	if maxAge > 0 && time.Since(task.CreateAt) > maxAge {
+		consoleLog("ERROR", "task expired, taskID: %s, created at: %s", task.TaskID, task.CreateAt.Format(time.RFC3339))
+		return errors.New("task expired")
+	}
+	return nil
+}
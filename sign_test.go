@@ -0,0 +1,175 @@
+package forge_connect
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	const appID, secret = "app-1", "secret-1"
+	s := NewServer("test").WithStore(NewMemoryStore())
+	record := ClientRecord{ClientInfo: ClientInfo{AppID: appID}, Secret: secret}
+	if err := s.store.SaveClientInfo(record, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := func(version, nonce string, dateTime time.Time, secret string) requestArgs {
+		args := requestArgs{
+			SignVersion: version,
+			AppID:       appID,
+			DateTime:    TimeFormat(dateTime),
+			Nonce:       nonce,
+			Method:      "POST",
+			Route:       apiRoutes["ping"],
+			Payload:     `{"tasks":[]}`,
+		}
+		args.Sign = hmacSign(secret, args.stringToSign())
+		return args
+	}
+	now := time.Now()
+	tampered := signed(SIGN_V2, "nonce-5", now, secret)
+	tampered.Route = apiRoutes["getTask"]
+	unknown := signed(SIGN_V2, "nonce-6", now, secret)
+	unknown.AppID = "app-2"
+
+	tests := []struct {
+		name string
+		args requestArgs
+		want bool
+	}{
+		{"v2", signed(SIGN_V2, "nonce-1", now, secret), true},
+		{"v2 replayed nonce", signed(SIGN_V2, "nonce-1", now, secret), false},
+		{"v1", signed(SIGN_V1, "nonce-2", now, secret), true},
+		{"v1 replayed nonce", signed(SIGN_V1, "nonce-2", now, secret), false},
+		{"v1 without nonce", signed(SIGN_V1, "", now, secret), true},
+		{"v2 wrong secret", signed(SIGN_V2, "nonce-3", now, "other"), false},
+		{"v2 expired time", signed(SIGN_V2, "nonce-4", now.Add(-10*time.Minute), secret), false},
+		{"v2 other route", tampered, false},
+		{"unknown client", unknown, false},
+		{"unknown version", signed("3", "nonce-7", now, secret), false},
+	}
+	for _, tt := range tests {
+		if got := s.verifySignature(tt.args); got != tt.want {
+			t.Errorf("%s: verifySignature = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	s.WithSignatureMigration(now.Add(-time.Minute))
+	if s.verifySignature(signed(SIGN_V1, "nonce-8", now, secret)) {
+		t.Error("v1 accepted after the signature migration")
+	}
+	if !s.verifySignature(signed(SIGN_V2, "nonce-9", now, secret)) {
+		t.Error("v2 rejected after the signature migration")
+	}
+}
+
+func TestReplayedRequestRejected(t *testing.T) {
+	_, ts := newTestServer(t)
+	c := registerTestClient(t, ts, "app-1")
+
+	dateTime, nonce := TimeFormat(time.Now()), randomHex(16)
+	send := func() Response {
+		req, _ := http.NewRequest("POST", ts.URL+apiRoutes["ping"], strings.NewReader("ping"))
+		req.Header.Set("X-FORGE-APPID", c.AppID)
+		req.Header.Set("X-FORGE-TIME", dateTime)
+		req.Header.Set("X-FORGE-NONCE", nonce)
+		req.Header.Set("X-FORGE-SIGN", c.generateSignature("ping", dateTime, nonce, "ping"))
+		req.Header.Set("X-FORGE-SIGN-VERSION", SIGN_V2)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body Response
+		if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	if resp := send(); resp.Code != 0 {
+		t.Fatalf("first request = %+v", resp)
+	}
+	if resp := send(); resp.Code == 0 {
+		t.Fatal("replayed request accepted")
+	}
+}
+
+func TestTaskSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newTestServer(t)
+	s.WithTaskSigningKey(privateKey)
+	c := registerTestClient(t, ts, "app-1").SetTaskPublicKey(publicKey)
+	called := false
+	c.handler = func(ctx context.Context, task *Task) (string, error) {
+		called = true
+		return "done", nil
+	}
+
+	if _, err = s.pushTask("app-1", Task{TaskType: "backup", Payload: "db"}); err != nil {
+		t.Fatal(err)
+	}
+	signed := fetchTestTask(t, c)
+	if err = c.verifyTask(signed); err != nil {
+		t.Fatal("signed task rejected:", err)
+	}
+
+	tampered := *signed
+	tampered.Payload = "rm -rf /"
+	other := NewForge("app-2", "secret").SetTaskPublicKey(publicKey)
+	for name, verify := range map[string]func() error{
+		"tampered payload": func() error { return c.verifyTask(&tampered) },
+		"other client":     func() error { return other.verifyTask(signed) },
+	} {
+		if verify() == nil {
+			t.Errorf("%s: task signature accepted", name)
+		}
+	}
+
+	// a task injected into the store without signature never reaches the handler
+	injected := Task{TaskID: "injected", TaskType: "backup", CreateAt: time.Now()}
+	if err = s.store.SaveTask("app-1", injected, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.store.PushTask("app-1", injected.TaskID, PRIORITY_NORMAL); err != nil {
+		t.Fatal(err)
+	}
+	c.runTask(fetchTestTask(t, c))
+	if called {
+		t.Fatal("unsigned task delivered to the handler")
+	}
+	if stored, err := s.store.GetTask("app-1", "injected"); err != nil || stored.DoStatus != STATUS_FAILED {
+		t.Fatalf("injected task = %+v, %v", stored, err)
+	}
+}
+
+func TestTaskSignatureMaxAge(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewForge("app-1", "secret").SetTaskPublicKey(publicKey).SetTaskMaxAge(time.Hour)
+	signedAt := func(createAt time.Time) *Task {
+		task := Task{TaskID: "task-1", TaskType: "backup", CreateAt: createAt}
+		task.Signature = signTask(privateKey, "app-1", task)
+		return &task
+	}
+	if err = c.verifyTask(signedAt(time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal("recent task rejected:", err)
+	}
+	// a captured task is not accepted once older than the max age, even with its valid signature
+	old := signedAt(time.Now().Add(-2 * time.Hour))
+	if err = c.verifyTask(old); err == nil {
+		t.Fatal("task older than the max age accepted")
+	}
+	if err = c.SetTaskMaxAge(0).verifyTask(old); err != nil {
+		t.Fatal("task rejected without max age:", err)
+	}
+}
@@ -0,0 +1,122 @@
+package forge_connect
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when the requested record or queue item does not exist
+var ErrNotFound = errors.New("record not found")
+
+// Store is the storage backend used by Server to share client and task state between replicas.
+// RedisStore is the default implementation, MemoryStore keeps everything in process for tests and single-node setups.
+type Store interface {
+	// GetClientInfo returns the registered client with its last ping time, ErrNotFound if it is unknown
+	GetClientInfo(appID string) (ClientRecord, error)
+	// SaveClientInfo stores the client info for the expire duration and indexes its appID
+	SaveClientInfo(info ClientRecord, expire time.Duration) error
+	// TouchClient records the ping time of a registered client and extends the expiration of its info
+	// without rewriting it, so a concurrent update of the secrets is never undone. ErrNotFound if it is unknown.
+	TouchClient(appID string, at time.Time, expire time.Duration) error
+	// DeleteClientInfo removes the client info
+	DeleteClientInfo(appID string) error
+	// ListClientIDs returns the sorted appIDs of every registered client that has not expired
+	ListClientIDs() ([]string, error)
+
+	// GetTask returns the task record, ErrNotFound if it is unknown
+	GetTask(appID, taskID string) (Task, error)
+	// SaveTask stores the task record for the expire duration
+	SaveTask(appID string, task Task, expire time.Duration) error
+
+	// PushTask appends a taskID to the pending queue of the client for the priority
+	PushTask(appID, taskID string, priority int) error
+	// PopTask moves the oldest pending taskID of the highest non-empty priority into the processing queue,
+	// ErrNotFound if every queue is empty
+	PopTask(appID string) (taskID string, err error)
+	// RemoveProcessing removes a taskID from the processing queue, it returns false when the taskID was not queued
+	RemoveProcessing(appID, taskID string) (bool, error)
+	// ListProcessing returns the taskIDs of the processing queue
+	ListProcessing(appID string) ([]string, error)
+
+	// AcquireLock takes the delivery lock of a task, it returns false when the lock is already held
+	AcquireLock(appID, taskID string, expire time.Duration) (bool, error)
+	// HasLock reports whether the delivery lock of a task is held
+	HasLock(appID, taskID string) (bool, error)
+	// ExtendLock resets the expiration of a held delivery lock, it returns false when the lock is not held
+	ExtendLock(appID, taskID string, expire time.Duration) (bool, error)
+
+	// PushDeadTask appends a taskID to the dead-letter queue of the client
+	PushDeadTask(appID, taskID string) error
+	// ListDeadTasks returns the taskIDs of the dead-letter queue, oldest first
+	ListDeadTasks(appID string) ([]string, error)
+	// RemoveDeadTask removes a taskID from the dead-letter queue, it returns false when the taskID was not queued
+	RemoveDeadTask(appID, taskID string) (bool, error)
+
+	// AddCancel records a cancel signal for a task delivered to the client
+	AddCancel(appID, taskID string) error
+	// PopCancels removes and returns the pending cancel signals of the client
+	PopCancels(appID string) ([]string, error)
+
+	// PushResult publishes the terminal state of a task so that any replica waiting on it can pick it up
+	PushResult(appID string, task Task, expire time.Duration) error
+	// PopResult removes the published result of a task, ErrNotFound if nothing is published yet
+	PopResult(appID, taskID string) (Task, error)
+
+	// MarkNonce records the nonce of a signed request, it returns false when the nonce was already recorded
+	MarkNonce(appID, nonce string, expire time.Duration) (bool, error)
+
+	// IncrRequestCount counts a request to the api of the scope ("app" or "ip") and id in the current rate window
+	IncrRequestCount(api, scope, id string, window time.Duration) (int64, error)
+	// IncrAuthFailure counts a failed authentication of the scope and id, the counter expires after window without failure
+	IncrAuthFailure(scope, id string, window time.Duration) (int64, error)
+	// SetLockout locks the scope and id out for the duration
+	SetLockout(scope, id string, duration time.Duration) error
+	// IsLockedOut reports whether the scope and id is locked out
+	IsLockedOut(scope, id string) (bool, error)
+
+	// SaveEnrollToken stores an enrollment token for the expire duration
+	SaveEnrollToken(token EnrollmentToken, expire time.Duration) error
+	// GetEnrollToken returns an enrollment token, ErrNotFound if it is unknown or expired
+	GetEnrollToken(tokenID string) (EnrollmentToken, error)
+	// UseEnrollToken atomically increments and returns the use counter of an enrollment token
+	UseEnrollToken(tokenID string, expire time.Duration) (int64, error)
+	// DeleteEnrollToken removes an enrollment token
+	DeleteEnrollToken(tokenID string) error
+
+	// SaveSchedule stores a scheduled task without expiration
+	SaveSchedule(sch ScheduledTask) error
+	// GetSchedule returns a scheduled task, ErrNotFound if it is unknown
+	GetSchedule(scheduleID string) (ScheduledTask, error)
+	// DeleteSchedule removes a scheduled task and its due entry
+	DeleteSchedule(scheduleID string) error
+	// AddDue sets the next due time of a scheduled task
+	AddDue(scheduleID string, dueAt time.Time) error
+	// ListDue returns the scheduleIDs waiting for their due time
+	ListDue() ([]string, error)
+	// ClaimDue returns up to limit scheduleIDs due before now and moves their due time to now+lease,
+	// every due entry is claimed by one caller across replicas. The caller sets the next due time
+	// or deletes the schedule once promoted, otherwise the entry is due again when the lease expires.
+	ClaimDue(now time.Time, lease time.Duration, limit int) ([]string, error)
+	// MarkScheduleRun records the activation runAt of a scheduled task for a client,
+	// it returns false when the activation was already recorded
+	MarkScheduleRun(scheduleID string, runAt time.Time, appID string, expire time.Duration) (bool, error)
+	// UnmarkScheduleRun removes the record of an activation which could not be promoted
+	UnmarkScheduleRun(scheduleID string, runAt time.Time, appID string) error
+
+	// SavePolicy stores a task policy without expiration
+	SavePolicy(policy TaskPolicy) error
+	// DeletePolicy removes a task policy
+	DeletePolicy(policyID string) error
+	// ListPolicies returns every task policy sorted by policyID
+	ListPolicies() ([]TaskPolicy, error)
+
+	// PushMessage appends a message to the stream of a continuous task
+	PushMessage(appID string, msg TaskMessage, expire time.Duration) error
+	// PopMessage removes the oldest message of a task stream, ErrNotFound if the stream is empty
+	PopMessage(appID, taskID string) (TaskMessage, error)
+}
+
+// rateSlot returns the index of the current rate window, the same on every replica
+func rateSlot(window time.Duration) int64 {
+	return time.Now().UnixNano() / int64(window)
+}
@@ -0,0 +1,591 @@
+package forge_connect
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements Store in process memory, it is meant for tests and single-node setups
+// because nothing is shared between server replicas.
+type MemoryStore struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+	lists  map[string]*memoryList
+	sets   map[string]map[string]struct{}
+	zsets  map[string]map[string]int64
+	writes int
+}
+
+type memoryValue struct {
+	data     []byte
+	expireAt time.Time
+}
+
+type memoryList struct {
+	items    [][]byte
+	expireAt time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		values: make(map[string]memoryValue),
+		lists:  make(map[string]*memoryList),
+		sets:   make(map[string]map[string]struct{}),
+		zsets:  make(map[string]map[string]int64),
+	}
+}
+
+// expired reports whether expireAt is set and already passed
+func expired(expireAt time.Time) bool {
+	return !expireAt.IsZero() && time.Now().After(expireAt)
+}
+
+// get return the value of key, the caller must hold the mutex
+func (m *MemoryStore) get(key string) ([]byte, bool) {
+	val, ok := m.values[key]
+	if !ok {
+		return nil, false
+	}
+	if expired(val.expireAt) {
+		delete(m.values, key)
+		return nil, false
+	}
+	return val.data, true
+}
+
+// set store the value of key, the caller must hold the mutex
+func (m *MemoryStore) set(key string, data []byte, expire time.Duration) {
+	val := memoryValue{data: data}
+	if expire > 0 {
+		val.expireAt = time.Now().Add(expire)
+	}
+	m.values[key] = val
+
+	// drop the expired keys which are never read again, e.g. nonces
+	m.writes++
+	if m.writes%1024 == 0 {
+		m.sweep()
+	}
+}
+
+// sweep remove every expired value and list, the caller must hold the mutex
+func (m *MemoryStore) sweep() {
+	for key, val := range m.values {
+		if expired(val.expireAt) {
+			delete(m.values, key)
+		}
+	}
+	for key, l := range m.lists {
+		if expired(l.expireAt) {
+			delete(m.lists, key)
+		}
+	}
+}
+
+// list return the list of key, create it when create is true, the caller must hold the mutex
+func (m *MemoryStore) list(key string, create bool) *memoryList {
+	l, ok := m.lists[key]
+	if ok && expired(l.expireAt) {
+		delete(m.lists, key)
+		ok = false
+	}
+	if !ok && create {
+		l = &memoryList{}
+		m.lists[key] = l
+		ok = true
+	}
+	if !ok {
+		return nil
+	}
+	return l
+}
+
+// popFront remove and return the first item of the list, the caller must hold the mutex
+func (m *MemoryStore) popFront(key string) ([]byte, bool) {
+	l := m.list(key, false)
+	if l == nil || len(l.items) == 0 {
+		return nil, false
+	}
+	item := l.items[0]
+	l.items = l.items[1:]
+	return item, true
+}
+
+// removeItem remove the first item equal to data, the caller must hold the mutex
+func (m *MemoryStore) removeItem(key string, data []byte) bool {
+	l := m.list(key, false)
+	if l == nil {
+		return false
+	}
+	for i, item := range l.items {
+		if string(item) == string(data) {
+			l.items = append(l.items[:i], l.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// listItems return a copy of the list items as strings, the caller must hold the mutex
+func (m *MemoryStore) listItems(key string) []string {
+	items := make([]string, 0)
+	if l := m.list(key, false); l != nil {
+		for _, item := range l.items {
+			items = append(items, string(item))
+		}
+	}
+	return items
+}
+
+// incr increment the counter of key and refresh its expiration, the caller must hold the mutex
+func (m *MemoryStore) incr(key string, expire time.Duration) int64 {
+	var count int64
+	if data, ok := m.get(key); ok {
+		count, _ = strconv.ParseInt(string(data), 10, 64)
+	}
+	count++
+	m.set(key, []byte(strconv.FormatInt(count, 10)), expire)
+	return count
+}
+
+// addMember add the member into the set of key, the caller must hold the mutex
+func (m *MemoryStore) addMember(key, member string) {
+	set, ok := m.sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		m.sets[key] = set
+	}
+	set[member] = struct{}{}
+}
+
+func (m *MemoryStore) getJSON(key string, v interface{}) error {
+	m.mu.Lock()
+	data, ok := m.get(key)
+	m.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (m *MemoryStore) setJSON(key string, v interface{}, expire time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, data, expire)
+	return nil
+}
+
+func (m *MemoryStore) GetClientInfo(appID string) (info ClientRecord, err error) {
+	if err = m.getJSON(GetClientInfoKey(appID), &info); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if data, ok := m.get(GetClientPingKey(appID)); ok {
+		if pingTime, _ := strconv.ParseInt(string(data), 10, 64); pingTime > info.LastPingTime {
+			info.LastPingTime = pingTime
+		}
+	}
+	return
+}
+
+func (m *MemoryStore) SaveClientInfo(info ClientRecord, expire time.Duration) error {
+	if err := m.setJSON(GetClientInfoKey(info.AppID), info, expire); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addMember(GetClientIndexKey(), info.AppID)
+	return nil
+}
+
+func (m *MemoryStore) TouchClient(appID string, at time.Time, expire time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.get(GetClientInfoKey(appID))
+	if !ok {
+		return ErrNotFound
+	}
+	m.set(GetClientInfoKey(appID), data, expire)
+	m.set(GetClientPingKey(appID), []byte(strconv.FormatInt(at.Unix(), 10)), expire)
+	return nil
+}
+
+func (m *MemoryStore) DeleteClientInfo(appID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, GetClientInfoKey(appID))
+	delete(m.values, GetClientPingKey(appID))
+	delete(m.sets[GetClientIndexKey()], appID)
+	return nil
+}
+
+func (m *MemoryStore) ListClientIDs() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	appIDs := make([]string, 0)
+	index := m.sets[GetClientIndexKey()]
+	for appID := range index {
+		if _, ok := m.get(GetClientInfoKey(appID)); !ok {
+			// the client info expired, drop it from the index
+			delete(index, appID)
+			continue
+		}
+		appIDs = append(appIDs, appID)
+	}
+	sort.Strings(appIDs)
+	return appIDs, nil
+}
+
+func (m *MemoryStore) GetTask(appID, taskID string) (task Task, err error) {
+	err = m.getJSON(GetTaskKey(appID, taskID), &task)
+	return
+}
+
+func (m *MemoryStore) SaveTask(appID string, task Task, expire time.Duration) error {
+	return m.setJSON(GetTaskKey(appID, task.TaskID), task, expire)
+}
+
+func (m *MemoryStore) PushTask(appID, taskID string, priority int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.list(GetPriorityQueueKey(appID, priority), true)
+	l.items = append(l.items, []byte(taskID))
+	return nil
+}
+
+func (m *MemoryStore) PopTask(appID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, priority := range taskPriorities {
+		item, ok := m.popFront(GetPriorityQueueKey(appID, priority))
+		if !ok {
+			continue
+		}
+		l := m.list(GetProcessingQueueKey(appID), true)
+		l.items = append(l.items, item)
+		return string(item), nil
+	}
+	return "", ErrNotFound
+}
+
+func (m *MemoryStore) RemoveProcessing(appID, taskID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeItem(GetProcessingQueueKey(appID), []byte(taskID)), nil
+}
+
+func (m *MemoryStore) ListProcessing(appID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.listItems(GetProcessingQueueKey(appID)), nil
+}
+
+func (m *MemoryStore) AcquireLock(appID, taskID string, expire time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lockKey := GetTaskLockKey(appID, taskID)
+	if _, ok := m.get(lockKey); ok {
+		return false, nil
+	}
+	m.set(lockKey, []byte("1"), expire)
+	return true, nil
+}
+
+func (m *MemoryStore) HasLock(appID, taskID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.get(GetTaskLockKey(appID, taskID))
+	return ok, nil
+}
+
+func (m *MemoryStore) ExtendLock(appID, taskID string, expire time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lockKey := GetTaskLockKey(appID, taskID)
+	data, ok := m.get(lockKey)
+	if ok {
+		m.set(lockKey, data, expire)
+	}
+	return ok, nil
+}
+
+func (m *MemoryStore) PushDeadTask(appID, taskID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.list(GetDeadQueueKey(appID), true)
+	l.items = append(l.items, []byte(taskID))
+	return nil
+}
+
+func (m *MemoryStore) ListDeadTasks(appID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.listItems(GetDeadQueueKey(appID)), nil
+}
+
+func (m *MemoryStore) RemoveDeadTask(appID, taskID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeItem(GetDeadQueueKey(appID), []byte(taskID)), nil
+}
+
+func (m *MemoryStore) AddCancel(appID, taskID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addMember(GetCancelSetKey(appID), taskID)
+	return nil
+}
+
+func (m *MemoryStore) PopCancels(appID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	taskIDs := make([]string, 0)
+	for taskID := range m.sets[GetCancelSetKey(appID)] {
+		taskIDs = append(taskIDs, taskID)
+	}
+	delete(m.sets, GetCancelSetKey(appID))
+	return taskIDs, nil
+}
+
+func (m *MemoryStore) PushResult(appID string, task Task, expire time.Duration) error {
+	taskJSON, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.list(GetTaskResultKey(appID, task.TaskID), true)
+	l.items = append(l.items, taskJSON)
+	l.expireAt = time.Now().Add(expire)
+	return nil
+}
+
+func (m *MemoryStore) PopResult(appID, taskID string) (task Task, err error) {
+	m.mu.Lock()
+	taskJSON, ok := m.popFront(GetTaskResultKey(appID, taskID))
+	m.mu.Unlock()
+	if !ok {
+		return task, ErrNotFound
+	}
+	err = json.Unmarshal(taskJSON, &task)
+	return
+}
+
+func (m *MemoryStore) MarkNonce(appID, nonce string, expire time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nonceKey := GetNonceKey(appID, nonce)
+	if _, ok := m.get(nonceKey); ok {
+		return false, nil
+	}
+	m.set(nonceKey, []byte("1"), expire)
+	return true, nil
+}
+
+func (m *MemoryStore) IncrRequestCount(api, scope, id string, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.incr(GetRateLimitKey(api, scope, id, rateSlot(window)), window), nil
+}
+
+func (m *MemoryStore) IncrAuthFailure(scope, id string, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.incr(GetAuthFailKey(scope, id), window), nil
+}
+
+func (m *MemoryStore) SetLockout(scope, id string, duration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(GetLockoutKey(scope, id), []byte("1"), duration)
+	return nil
+}
+
+func (m *MemoryStore) IsLockedOut(scope, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.get(GetLockoutKey(scope, id))
+	return ok, nil
+}
+
+func (m *MemoryStore) SaveEnrollToken(token EnrollmentToken, expire time.Duration) error {
+	return m.setJSON(GetEnrollTokenKey(token.TokenID), token, expire)
+}
+
+func (m *MemoryStore) GetEnrollToken(tokenID string) (token EnrollmentToken, err error) {
+	err = m.getJSON(GetEnrollTokenKey(tokenID), &token)
+	return
+}
+
+func (m *MemoryStore) UseEnrollToken(tokenID string, expire time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.incr(GetEnrollUsesKey(tokenID), expire), nil
+}
+
+func (m *MemoryStore) DeleteEnrollToken(tokenID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, GetEnrollTokenKey(tokenID))
+	delete(m.values, GetEnrollUsesKey(tokenID))
+	return nil
+}
+
+func (m *MemoryStore) SaveSchedule(sch ScheduledTask) error {
+	return m.setJSON(GetScheduleKey(sch.ScheduleID), sch, 0)
+}
+
+func (m *MemoryStore) GetSchedule(scheduleID string) (sch ScheduledTask, err error) {
+	err = m.getJSON(GetScheduleKey(scheduleID), &sch)
+	return
+}
+
+func (m *MemoryStore) DeleteSchedule(scheduleID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.zsets[GetScheduleDueKey()], scheduleID)
+	delete(m.values, GetScheduleKey(scheduleID))
+	return nil
+}
+
+func (m *MemoryStore) AddDue(scheduleID string, dueAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	due, ok := m.zsets[GetScheduleDueKey()]
+	if !ok {
+		due = make(map[string]int64)
+		m.zsets[GetScheduleDueKey()] = due
+	}
+	due[scheduleID] = dueAt.Unix()
+	return nil
+}
+
+func (m *MemoryStore) ListDue() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedDue(0, false), nil
+}
+
+func (m *MemoryStore) ClaimDue(now time.Time, lease time.Duration, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	scheduleIDs := m.sortedDue(now.Unix(), true)
+	if len(scheduleIDs) > limit {
+		scheduleIDs = scheduleIDs[:limit]
+	}
+	for _, scheduleID := range scheduleIDs {
+		m.zsets[GetScheduleDueKey()][scheduleID] = now.Add(lease).Unix()
+	}
+	return scheduleIDs, nil
+}
+
+func (m *MemoryStore) MarkScheduleRun(scheduleID string, runAt time.Time, appID string, expire time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runKey := GetScheduleRunKey(scheduleID, runAt.Unix(), appID)
+	if _, ok := m.get(runKey); ok {
+		return false, nil
+	}
+	m.set(runKey, []byte("1"), expire)
+	return true, nil
+}
+
+func (m *MemoryStore) UnmarkScheduleRun(scheduleID string, runAt time.Time, appID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, GetScheduleRunKey(scheduleID, runAt.Unix(), appID))
+	return nil
+}
+
+// sortedDue return the due scheduleIDs ordered by due time, limited to maxScore when bounded, the caller must hold the mutex
+func (m *MemoryStore) sortedDue(maxScore int64, bounded bool) []string {
+	due := m.zsets[GetScheduleDueKey()]
+	scheduleIDs := make([]string, 0, len(due))
+	for scheduleID, score := range due {
+		if bounded && score > maxScore {
+			continue
+		}
+		scheduleIDs = append(scheduleIDs, scheduleID)
+	}
+	sort.Slice(scheduleIDs, func(i, j int) bool {
+		if due[scheduleIDs[i]] != due[scheduleIDs[j]] {
+			return due[scheduleIDs[i]] < due[scheduleIDs[j]]
+		}
+		return scheduleIDs[i] < scheduleIDs[j]
+	})
+	return scheduleIDs
+}
+
+func (m *MemoryStore) PushMessage(appID string, msg TaskMessage, expire time.Duration) error {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.list(GetTaskMessageKey(appID, msg.TaskID), true)
+	l.items = append(l.items, msgJSON)
+	l.expireAt = time.Now().Add(expire)
+	return nil
+}
+
+func (m *MemoryStore) PopMessage(appID, taskID string) (msg TaskMessage, err error) {
+	m.mu.Lock()
+	msgJSON, ok := m.popFront(GetTaskMessageKey(appID, taskID))
+	m.mu.Unlock()
+	if !ok {
+		return msg, ErrNotFound
+	}
+	err = json.Unmarshal(msgJSON, &msg)
+	return
+}
+
+func (m *MemoryStore) SavePolicy(policy TaskPolicy) error {
+	if err := m.setJSON(GetPolicyKey(policy.PolicyID), policy, 0); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addMember(GetPolicyIndexKey(), policy.PolicyID)
+	return nil
+}
+
+func (m *MemoryStore) DeletePolicy(policyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, GetPolicyKey(policyID))
+	delete(m.sets[GetPolicyIndexKey()], policyID)
+	return nil
+}
+
+func (m *MemoryStore) ListPolicies() (policies []TaskPolicy, err error) {
+	m.mu.Lock()
+	policyIDs := make([]string, 0)
+	for policyID := range m.sets[GetPolicyIndexKey()] {
+		policyIDs = append(policyIDs, policyID)
+	}
+	m.mu.Unlock()
+	sort.Strings(policyIDs)
+	for _, policyID := range policyIDs {
+		var policy TaskPolicy
+		err = m.getJSON(GetPolicyKey(policyID), &policy)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
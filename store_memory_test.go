@@ -0,0 +1,139 @@
+package forge_connect
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTaskQueue(t *testing.T) {
+	m := NewMemoryStore()
+	pushes := []struct {
+		taskID   string
+		priority int
+	}{
+		{"t1", PRIORITY_NORMAL},
+		{"t2", PRIORITY_LOW},
+		{"t3", PRIORITY_NORMAL},
+		{"t4", PRIORITY_URGENT},
+	}
+	for _, push := range pushes {
+		if err := m.PushTask("app", push.taskID, push.priority); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"t4", "t1", "t3", "t2"} {
+		if taskID, err := m.PopTask("app"); err != nil || taskID != want {
+			t.Fatalf("PopTask = %q, %v, want %q", taskID, err, want)
+		}
+	}
+	if _, err := m.PopTask("app"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("PopTask of an empty queue error = %v, want ErrNotFound", err)
+	}
+	if removed, err := m.RemoveProcessing("app", "t1"); err != nil || !removed {
+		t.Fatalf("RemoveProcessing = %v, %v, want true", removed, err)
+	}
+	if removed, _ := m.RemoveProcessing("app", "t1"); removed {
+		t.Fatal("RemoveProcessing of a removed task returned true")
+	}
+}
+
+func TestMemoryStoreLockAndExpire(t *testing.T) {
+	m := NewMemoryStore()
+	if ok, err := m.AcquireLock("app", "t1", time.Minute); err != nil || !ok {
+		t.Fatalf("AcquireLock = %v, %v, want true", ok, err)
+	}
+	if ok, _ := m.AcquireLock("app", "t1", time.Minute); ok {
+		t.Fatal("AcquireLock of a held lock succeeded")
+	}
+
+	if err := m.SaveTask("app", Task{TaskID: "t1"}, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if task, err := m.GetTask("app", "t1"); err != nil || task.TaskID != "t1" {
+		t.Fatalf("GetTask = %+v, %v", task, err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, err := m.GetTask("app", "t1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetTask of an expired task error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStoreMarkNonce(t *testing.T) {
+	m := NewMemoryStore()
+	if fresh, err := m.MarkNonce("app", "n1", 20*time.Millisecond); err != nil || !fresh {
+		t.Fatalf("MarkNonce = %v, %v, want fresh", fresh, err)
+	}
+	if fresh, _ := m.MarkNonce("app", "n1", 20*time.Millisecond); fresh {
+		t.Fatal("MarkNonce of a seen nonce is fresh")
+	}
+	if fresh, _ := m.MarkNonce("other", "n1", 20*time.Millisecond); !fresh {
+		t.Fatal("nonce of another app is not fresh")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if fresh, _ := m.MarkNonce("app", "n1", 20*time.Millisecond); !fresh {
+		t.Fatal("expired nonce is not fresh")
+	}
+}
+
+func TestMemoryStoreRateCounters(t *testing.T) {
+	m := NewMemoryStore()
+	for want := int64(1); want <= 2; want++ {
+		if count, err := m.IncrRequestCount("ping", scopeApp, "app", time.Minute); err != nil || count != want {
+			t.Fatalf("IncrRequestCount = %d, %v, want %d", count, err, want)
+		}
+	}
+	if count, _ := m.IncrRequestCount("getTask", scopeApp, "app", time.Minute); count != 1 {
+		t.Fatalf("IncrRequestCount of another api = %d, want 1", count)
+	}
+	if failures, _ := m.IncrAuthFailure(scopeIP, "10.0.0.1", time.Minute); failures != 1 {
+		t.Fatalf("IncrAuthFailure = %d, want 1", failures)
+	}
+
+	if err := m.SetLockout(scopeIP, "10.0.0.1", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := m.IsLockedOut(scopeIP, "10.0.0.1"); err != nil || !locked {
+		t.Fatalf("IsLockedOut = %v, %v, want true", locked, err)
+	}
+	if locked, _ := m.IsLockedOut(scopeApp, "10.0.0.1"); locked {
+		t.Fatal("lockout of another scope")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if locked, _ := m.IsLockedOut(scopeIP, "10.0.0.1"); locked {
+		t.Fatal("lockout not expired")
+	}
+}
+
+func TestMemoryStoreMessages(t *testing.T) {
+	m := NewMemoryStore()
+	for _, content := range []string{"first", "second"} {
+		if err := m.PushMessage("app", TaskMessage{TaskID: "t1", Content: content}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"first", "second"} {
+		if msg, err := m.PopMessage("app", "t1"); err != nil || msg.Content != want {
+			t.Fatalf("PopMessage = %+v, %v, want %q", msg, err, want)
+		}
+	}
+	if _, err := m.PopMessage("app", "t1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("PopMessage of an empty stream error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStoreResults(t *testing.T) {
+	m := NewMemoryStore()
+	if _, err := m.PopResult("app", "t1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("PopResult before the result error = %v, want ErrNotFound", err)
+	}
+	if err := m.PushResult("app", Task{TaskID: "t1", Result: "ok"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if task, err := m.PopResult("app", "t1"); err != nil || task.Result != "ok" {
+		t.Fatalf("PopResult = %+v, %v", task, err)
+	}
+	if _, err := m.PopResult("app", "t1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("PopResult of a consumed result error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,434 @@
+package forge_connect
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	rdx "github.com/gomodule/redigo/redis"
+)
+
+// RedisStore implements Store on top of redis
+type RedisStore struct {
+	conn rdx.Conn
+	pool *rdx.Pool
+}
+
+// NewRedisStore use a single redis connection, the caller owns the connection
+func NewRedisStore(conn rdx.Conn) *RedisStore {
+	return &RedisStore{conn: conn}
+}
+
+// NewRedisPoolStore borrow a connection from the pool for every command,
+// use it for long-running background work that outlives a http request
+func NewRedisPoolStore(pool *rdx.Pool) *RedisStore {
+	return &RedisStore{pool: pool}
+}
+
+func (r *RedisStore) do(command string, args ...interface{}) (interface{}, error) {
+	if r.pool != nil {
+		conn := r.pool.Get()
+		defer conn.Close()
+		return conn.Do(command, args...)
+	}
+	if r.conn == nil {
+		return nil, errors.New("redis connection not found")
+	}
+	return r.conn.Do(command, args...)
+}
+
+// getJSON load the key into v, ErrNotFound if the key is missing
+func (r *RedisStore) getJSON(key string, v interface{}) (err error) {
+	data, err := rdx.Bytes(r.do("GET", key))
+	if errors.Is(err, rdx.ErrNil) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(data, v)
+}
+
+// setJSON store v into the key for the expire duration
+func (r *RedisStore) setJSON(key string, v interface{}, expire time.Duration) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	_, err = r.do("SETEX", key, expireSeconds(expire), data)
+	return
+}
+
+func (r *RedisStore) GetClientInfo(appID string) (info ClientRecord, err error) {
+	if err = r.getJSON(GetClientInfoKey(appID), &info); err != nil {
+		return
+	}
+	pingTime, err := rdx.Int64(r.do("GET", GetClientPingKey(appID)))
+	if errors.Is(err, rdx.ErrNil) {
+		return info, nil
+	}
+	if pingTime > info.LastPingTime {
+		info.LastPingTime = pingTime
+	}
+	return
+}
+
+func (r *RedisStore) SaveClientInfo(info ClientRecord, expire time.Duration) (err error) {
+	if err = r.setJSON(GetClientInfoKey(info.AppID), info, expire); err != nil {
+		return
+	}
+	_, err = r.do("SADD", GetClientIndexKey(), info.AppID)
+	return
+}
+
+func (r *RedisStore) TouchClient(appID string, at time.Time, expire time.Duration) error {
+	exists, err := rdx.Bool(r.do("EXPIRE", GetClientInfoKey(appID), expireSeconds(expire)))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	_, err = r.do("SETEX", GetClientPingKey(appID), expireSeconds(expire), at.Unix())
+	return err
+}
+
+func (r *RedisStore) DeleteClientInfo(appID string) (err error) {
+	if _, err = r.do("DEL", GetClientInfoKey(appID), GetClientPingKey(appID)); err != nil {
+		return
+	}
+	_, err = r.do("SREM", GetClientIndexKey(), appID)
+	return
+}
+
+func (r *RedisStore) ListClientIDs() (appIDs []string, err error) {
+	members, err := rdx.Strings(r.do("SMEMBERS", GetClientIndexKey()))
+	if err != nil {
+		return
+	}
+	for _, appID := range members {
+		exists, err := rdx.Bool(r.do("EXISTS", GetClientInfoKey(appID)))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			// the client info expired, drop it from the index
+			_, _ = r.do("SREM", GetClientIndexKey(), appID)
+			continue
+		}
+		appIDs = append(appIDs, appID)
+	}
+	sort.Strings(appIDs)
+	return
+}
+
+func (r *RedisStore) GetTask(appID, taskID string) (task Task, err error) {
+	err = r.getJSON(GetTaskKey(appID, taskID), &task)
+	return
+}
+
+func (r *RedisStore) SaveTask(appID string, task Task, expire time.Duration) error {
+	return r.setJSON(GetTaskKey(appID, task.TaskID), task, expire)
+}
+
+func (r *RedisStore) PushTask(appID, taskID string, priority int) (err error) {
+	_, err = r.do("LPUSH", GetPriorityQueueKey(appID, priority), taskID)
+	return
+}
+
+func (r *RedisStore) PopTask(appID string) (taskID string, err error) {
+	for _, priority := range taskPriorities {
+		taskID, err = rdx.String(r.do("RPOPLPUSH", GetPriorityQueueKey(appID, priority), GetProcessingQueueKey(appID)))
+		if !errors.Is(err, rdx.ErrNil) {
+			return
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (r *RedisStore) RemoveProcessing(appID, taskID string) (bool, error) {
+	removed, err := rdx.Int(r.do("LREM", GetProcessingQueueKey(appID), 1, taskID))
+	return removed > 0, err
+}
+
+func (r *RedisStore) ListProcessing(appID string) ([]string, error) {
+	return rdx.Strings(r.do("LRANGE", GetProcessingQueueKey(appID), 0, -1))
+}
+
+func (r *RedisStore) AcquireLock(appID, taskID string, expire time.Duration) (bool, error) {
+	_, err := rdx.String(r.do("SET", GetTaskLockKey(appID, taskID), "1", "EX", expireSeconds(expire), "NX"))
+	if errors.Is(err, rdx.ErrNil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RedisStore) AddCancel(appID, taskID string) (err error) {
+	cancelKey := GetCancelSetKey(appID)
+	if _, err = r.do("SADD", cancelKey, taskID); err != nil {
+		return
+	}
+	_, err = r.do("EXPIRE", cancelKey, RDX_EXPIRE)
+	return
+}
+
+func (r *RedisStore) PopCancels(appID string) (taskIDs []string, err error) {
+	taskIDs, err = rdx.Strings(r.do("SPOP", GetCancelSetKey(appID), 100))
+	if errors.Is(err, rdx.ErrNil) {
+		err = nil
+	}
+	return
+}
+
+func (r *RedisStore) PushResult(appID string, task Task, expire time.Duration) (err error) {
+	taskJSON, err := json.Marshal(task)
+	if err != nil {
+		return
+	}
+	resultKey := GetTaskResultKey(appID, task.TaskID)
+	if _, err = r.do("RPUSH", resultKey, taskJSON); err != nil {
+		return
+	}
+	_, err = r.do("EXPIRE", resultKey, expireSeconds(expire))
+	return
+}
+
+func (r *RedisStore) PopResult(appID, taskID string) (task Task, err error) {
+	taskJSON, err := rdx.Bytes(r.do("LPOP", GetTaskResultKey(appID, taskID)))
+	if errors.Is(err, rdx.ErrNil) {
+		return task, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(taskJSON, &task)
+	return
+}
+
+func (r *RedisStore) HasLock(appID, taskID string) (bool, error) {
+	return rdx.Bool(r.do("EXISTS", GetTaskLockKey(appID, taskID)))
+}
+
+func (r *RedisStore) ExtendLock(appID, taskID string, expire time.Duration) (bool, error) {
+	return rdx.Bool(r.do("EXPIRE", GetTaskLockKey(appID, taskID), expireSeconds(expire)))
+}
+
+func (r *RedisStore) PushDeadTask(appID, taskID string) (err error) {
+	_, err = r.do("RPUSH", GetDeadQueueKey(appID), taskID)
+	return
+}
+
+func (r *RedisStore) ListDeadTasks(appID string) ([]string, error) {
+	return rdx.Strings(r.do("LRANGE", GetDeadQueueKey(appID), 0, -1))
+}
+
+func (r *RedisStore) RemoveDeadTask(appID, taskID string) (bool, error) {
+	removed, err := rdx.Int(r.do("LREM", GetDeadQueueKey(appID), 1, taskID))
+	return removed > 0, err
+}
+
+func (r *RedisStore) MarkNonce(appID, nonce string, expire time.Duration) (bool, error) {
+	_, err := rdx.String(r.do("SET", GetNonceKey(appID, nonce), "1", "EX", expireSeconds(expire), "NX"))
+	if errors.Is(err, rdx.ErrNil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RedisStore) IncrRequestCount(api, scope, id string, window time.Duration) (count int64, err error) {
+	counterKey := GetRateLimitKey(api, scope, id, rateSlot(window))
+	if count, err = rdx.Int64(r.do("INCR", counterKey)); err != nil {
+		return
+	}
+	if count == 1 {
+		_, err = r.do("EXPIRE", counterKey, expireSeconds(window))
+	}
+	return
+}
+
+func (r *RedisStore) IncrAuthFailure(scope, id string, window time.Duration) (failures int64, err error) {
+	failKey := GetAuthFailKey(scope, id)
+	if failures, err = rdx.Int64(r.do("INCR", failKey)); err != nil {
+		return
+	}
+	_, err = r.do("EXPIRE", failKey, expireSeconds(window))
+	return
+}
+
+func (r *RedisStore) SetLockout(scope, id string, duration time.Duration) (err error) {
+	_, err = r.do("SETEX", GetLockoutKey(scope, id), expireSeconds(duration), "1")
+	return
+}
+
+func (r *RedisStore) IsLockedOut(scope, id string) (bool, error) {
+	return rdx.Bool(r.do("EXISTS", GetLockoutKey(scope, id)))
+}
+
+func (r *RedisStore) SaveEnrollToken(token EnrollmentToken, expire time.Duration) error {
+	return r.setJSON(GetEnrollTokenKey(token.TokenID), token, expire)
+}
+
+func (r *RedisStore) GetEnrollToken(tokenID string) (token EnrollmentToken, err error) {
+	err = r.getJSON(GetEnrollTokenKey(tokenID), &token)
+	return
+}
+
+func (r *RedisStore) UseEnrollToken(tokenID string, expire time.Duration) (uses int64, err error) {
+	usesKey := GetEnrollUsesKey(tokenID)
+	if uses, err = rdx.Int64(r.do("INCR", usesKey)); err != nil {
+		return
+	}
+	_, err = r.do("EXPIRE", usesKey, expireSeconds(expire))
+	return
+}
+
+func (r *RedisStore) DeleteEnrollToken(tokenID string) (err error) {
+	_, err = r.do("DEL", GetEnrollTokenKey(tokenID), GetEnrollUsesKey(tokenID))
+	return
+}
+
+func (r *RedisStore) SaveSchedule(sch ScheduledTask) (err error) {
+	data, err := json.Marshal(sch)
+	if err != nil {
+		return
+	}
+	_, err = r.do("SET", GetScheduleKey(sch.ScheduleID), data)
+	return
+}
+
+func (r *RedisStore) GetSchedule(scheduleID string) (sch ScheduledTask, err error) {
+	err = r.getJSON(GetScheduleKey(scheduleID), &sch)
+	return
+}
+
+func (r *RedisStore) DeleteSchedule(scheduleID string) (err error) {
+	if _, err = r.do("ZREM", GetScheduleDueKey(), scheduleID); err != nil {
+		return
+	}
+	_, err = r.do("DEL", GetScheduleKey(scheduleID))
+	return
+}
+
+func (r *RedisStore) AddDue(scheduleID string, dueAt time.Time) (err error) {
+	_, err = r.do("ZADD", GetScheduleDueKey(), dueAt.Unix(), scheduleID)
+	return
+}
+
+func (r *RedisStore) ListDue() ([]string, error) {
+	return rdx.Strings(r.do("ZRANGE", GetScheduleDueKey(), 0, -1))
+}
+
+// claimDueScript moves a due entry to its lease time, unless another replica claimed it first
+const claimDueScript = `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) <= tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+	return 1
+end
+return 0`
+
+func (r *RedisStore) ClaimDue(now time.Time, lease time.Duration, limit int) (scheduleIDs []string, err error) {
+	dueIDs, err := rdx.Strings(r.do("ZRANGEBYSCORE", GetScheduleDueKey(), "-inf", now.Unix(), "LIMIT", 0, limit))
+	if err != nil {
+		return
+	}
+	leaseUntil := now.Add(lease).Unix()
+	for _, scheduleID := range dueIDs {
+		claimed, err := rdx.Int(r.do("EVAL", claimDueScript, 1, GetScheduleDueKey(), scheduleID, now.Unix(), leaseUntil))
+		if err != nil {
+			return scheduleIDs, err
+		}
+		if claimed > 0 {
+			scheduleIDs = append(scheduleIDs, scheduleID)
+		}
+	}
+	return
+}
+
+func (r *RedisStore) MarkScheduleRun(scheduleID string, runAt time.Time, appID string, expire time.Duration) (bool, error) {
+	_, err := rdx.String(r.do("SET", GetScheduleRunKey(scheduleID, runAt.Unix(), appID), "1", "EX", expireSeconds(expire), "NX"))
+	if errors.Is(err, rdx.ErrNil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RedisStore) UnmarkScheduleRun(scheduleID string, runAt time.Time, appID string) (err error) {
+	_, err = r.do("DEL", GetScheduleRunKey(scheduleID, runAt.Unix(), appID))
+	return
+}
+
+func (r *RedisStore) PushMessage(appID string, msg TaskMessage, expire time.Duration) (err error) {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	msgKey := GetTaskMessageKey(appID, msg.TaskID)
+	if _, err = r.do("RPUSH", msgKey, msgJSON); err != nil {
+		return
+	}
+	_, err = r.do("EXPIRE", msgKey, expireSeconds(expire))
+	return
+}
+
+func (r *RedisStore) PopMessage(appID, taskID string) (msg TaskMessage, err error) {
+	msgJSON, err := rdx.Bytes(r.do("LPOP", GetTaskMessageKey(appID, taskID)))
+	if errors.Is(err, rdx.ErrNil) {
+		return msg, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(msgJSON, &msg)
+	return
+}
+
+func (r *RedisStore) SavePolicy(policy TaskPolicy) (err error) {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return
+	}
+	if _, err = r.do("SET", GetPolicyKey(policy.PolicyID), data); err != nil {
+		return
+	}
+	_, err = r.do("SADD", GetPolicyIndexKey(), policy.PolicyID)
+	return
+}
+
+func (r *RedisStore) DeletePolicy(policyID string) (err error) {
+	if _, err = r.do("DEL", GetPolicyKey(policyID)); err != nil {
+		return
+	}
+	_, err = r.do("SREM", GetPolicyIndexKey(), policyID)
+	return
+}
+
+func (r *RedisStore) ListPolicies() (policies []TaskPolicy, err error) {
+	policyIDs, err := rdx.Strings(r.do("SMEMBERS", GetPolicyIndexKey()))
+	if err != nil {
+		return
+	}
+	sort.Strings(policyIDs)
+	for _, policyID := range policyIDs {
+		var policy TaskPolicy
+		err = r.getJSON(GetPolicyKey(policyID), &policy)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// expireSeconds convert the duration to redis seconds, at least one second
+func expireSeconds(expire time.Duration) int64 {
+	seconds := int64(expire / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -1,6 +1,8 @@
 package forge_connect
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"time"
@@ -40,6 +42,15 @@ func TimeFormat(tm time.Time) string {
 	return tm.Format("2006-01-02 15:04:05")
 }
 
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic("crypto/rand unavailable: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
 // consoleRouter show http handler router
 func consoleRouter(method, patten string) {
 	spaceLen := 7 - len(method)